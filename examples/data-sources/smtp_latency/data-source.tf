@@ -0,0 +1,5 @@
+data "smtp_latency" "this" {}
+
+output "smtp_latency_ms" {
+  value = data.smtp_latency.this.total_ms
+}
@@ -0,0 +1,6 @@
+ephemeral "smtp_send_mail" "this" {
+  to      = ["to@example.com"]
+  from    = "from@example.com"
+  subject = "Deployment started"
+  body    = "The deployment has started."
+}
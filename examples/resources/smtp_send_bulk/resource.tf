@@ -0,0 +1,29 @@
+resource "smtp_send_bulk" "this" {
+  from = "from@example.com"
+
+  messages = [
+    {
+      to            = ["alice@example.com"]
+      subject       = "Welcome Alice"
+      body          = "Hello {{.name}}, welcome aboard."
+      template_vars = { name = "Alice" }
+    },
+    {
+      to            = ["bob@example.com"]
+      subject       = "Welcome Bob"
+      body          = "Hello {{.name}}, welcome aboard."
+      template_vars = { name = "Bob" }
+    },
+  ]
+}
+
+# subscribers.csv:
+# email,name
+# alice@example.com,Alice
+# bob@example.com,Bob
+resource "smtp_send_bulk" "newsletter" {
+  from            = "news@example.com"
+  recipients_file = "${path.module}/subscribers.csv"
+  subject         = "Our monthly newsletter"
+  body            = "Hello {{.name}}, here is what happened this month."
+}
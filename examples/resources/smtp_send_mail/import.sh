@@ -0,0 +1,4 @@
+# An already sent email can be imported by any id, without sending it again.
+# The email attributes are not recoverable: they show as changes until the
+# next apply, which records them in the state without sending the email.
+terraform import smtp_send_mail.this 5b1f6c2e-3d4a-4e8b-9c7d-2a6f0e1b8c9d
@@ -0,0 +1,184 @@
+package smtp
+
+import (
+	"errors"
+	"fmt"
+	"net/smtp"
+	"strings"
+)
+
+// authMechanisms lists the supported auth_mechanism values, the automatic
+// negotiation preferring the most secure mechanism first.
+var authMechanisms = []string{"cram-md5", "login", "plain"}
+
+// oauthMechanisms lists the auth_mechanism values authenticating with an OAuth
+// 2.0 access token, which are never negotiated.
+var oauthMechanisms = []string{"xoauth2", "oauthbearer"}
+
+// newAuth returns the SMTP authentication with the credentials for the session
+// with the given host. In auto mode, the mechanism is picked from the ones
+// advertised by the server.
+func (c *client) newAuth(conn *smtp.Client, host string, creds *credentials) (smtp.Auth, error) {
+	mechanism, err := c.resolveAuthMechanism(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	switch mechanism {
+	case "cram-md5":
+		return smtp.CRAMMD5Auth(creds.username, creds.password), nil
+	case "login":
+		return &loginAuth{username: creds.username, password: creds.password, host: host}, nil
+	case "external":
+		return &externalAuth{identity: c.authIdentity}, nil
+	case "xoauth2", "oauthbearer":
+		return &oauthAuth{mechanism: strings.ToUpper(mechanism), username: creds.username, token: creds.password, host: host}, nil
+	default:
+		return smtp.PlainAuth(c.authIdentity, creds.username, creds.password, host), nil
+	}
+}
+
+// resolveAuthMechanism returns the configured auth mechanism or, with auto,
+// the one negotiated with the server over the session.
+func (c *client) resolveAuthMechanism(conn *smtp.Client) (string, error) {
+	if c.authMechanism != "auto" {
+		return c.authMechanism, nil
+	}
+	_, advertised := conn.Extension("AUTH")
+	mechanism := negotiateAuthMechanism(advertised)
+	if mechanism == "" {
+		return "", fmt.Errorf("none of the supported authentication mechanisms (%s) is offered by the server, which offers: %s",
+			strings.ToUpper(strings.Join(authMechanisms, ", ")), advertised)
+	}
+	return mechanism, nil
+}
+
+// explainAuthRefusal clarifies the errors PlainAuth and loginAuth return when
+// they refuse to send the credentials, before anything reaches the server.
+func explainAuthRefusal(err error) error {
+	switch err.Error() {
+	case "unencrypted connection":
+		return fmt.Errorf("%w: the credentials are only sent over TLS, set tls_mode to starttls or implicit, or allow_insecure_auth to authenticate anyway", err)
+	case "wrong host name":
+		return fmt.Errorf("%w: the credentials are for a host other than the server name of the session", err)
+	}
+	return err
+}
+
+// negotiateAuthMechanism returns the most secure supported mechanism from the
+// ones advertised in the EHLO AUTH line, or an empty string if there is none.
+func negotiateAuthMechanism(advertised string) string {
+	offered := map[string]bool{}
+	for _, mechanism := range strings.Fields(advertised) {
+		offered[strings.ToLower(mechanism)] = true
+	}
+
+	for _, mechanism := range authMechanisms {
+		if offered[mechanism] {
+			return mechanism
+		}
+	}
+	return ""
+}
+
+// insecureAuth lets the wrapped mechanism send the credentials over an
+// unencrypted connection, which PlainAuth and loginAuth refuse otherwise.
+type insecureAuth struct {
+	smtp.Auth
+}
+
+func (a insecureAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	info := *server
+	info.TLS = true
+	return a.Auth.Start(&info)
+}
+
+// externalAuth implements the RFC 4422 EXTERNAL authentication mechanism, the
+// server authenticating the client with its TLS certificate. The authorization
+// identity, if any, is sent as the initial response; otherwise the empty
+// initial response is sent as "=" per RFC 4954, which the stdlib cannot encode
+// and is appended to the mechanism name instead.
+type externalAuth struct {
+	identity string
+}
+
+func (a *externalAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	// The client certificate is only presented over TLS.
+	if !server.TLS {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if a.identity == "" {
+		return "EXTERNAL =", nil, nil
+	}
+	return "EXTERNAL", []byte(a.identity), nil
+}
+
+func (a *externalAuth) Next(_ []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	return []byte{}, nil
+}
+
+// oauthAuth implements the XOAUTH2 and RFC 7628 OAUTHBEARER authentication
+// mechanisms, which send the OAuth 2.0 access token as the initial response.
+type oauthAuth struct {
+	mechanism, username, token, host string
+}
+
+func (a *oauthAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	// Like PlainAuth, only send the token over TLS or to localhost.
+	if !server.TLS && server.Name != "localhost" && server.Name != "127.0.0.1" && server.Name != "::1" {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	if a.mechanism == "XOAUTH2" {
+		return a.mechanism, []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+	}
+	// The GS2 header escapes the commas and equal signs of the username.
+	username := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(a.username)
+	return a.mechanism, []byte("n,a=" + username + ",\x01host=" + a.host + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+func (a *oauthAuth) Next(_ []byte, more bool) ([]byte, error) {
+	// A failure is detailed in a challenge, answered with an empty response
+	// for the server to end the exchange with its error reply.
+	if !more {
+		return nil, nil
+	}
+	return []byte{}, nil
+}
+
+// loginAuth implements the LOGIN authentication mechanism, which the stdlib
+// does not provide.
+type loginAuth struct {
+	username, password, host string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	// Like PlainAuth, only send the credentials over TLS or to localhost.
+	if !server.TLS && server.Name != "localhost" && server.Name != "127.0.0.1" && server.Name != "::1" {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	default:
+		return nil, fmt.Errorf("unexpected server challenge: %s", fromServer)
+	}
+}
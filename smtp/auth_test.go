@@ -0,0 +1,162 @@
+package smtp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPlainAuthServerName(t *testing.T) {
+	tests := []struct {
+		name    string
+		host    string
+		tlsMode string
+		config  map[string]any
+		wantErr string
+	}{
+		{name: "starttls with a host name", host: "localhost", tlsMode: "starttls"},
+		{name: "starttls with an ip address", host: "127.0.0.1", tlsMode: "starttls"},
+		{name: "implicit with a host name", host: "localhost", tlsMode: "implicit"},
+		{name: "unencrypted to localhost", host: "127.0.0.1", tlsMode: "none"},
+		{
+			name:    "unencrypted to another host",
+			host:    "127.0.0.2",
+			tlsMode: "none",
+			wantErr: "unencrypted connection: the credentials are only sent over TLS",
+		},
+		{
+			name:    "unencrypted to another host allowed",
+			host:    "127.0.0.2",
+			tlsMode: "none",
+			config:  map[string]any{"allow_insecure_auth": true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			address := "127.0.0.1:0"
+			if tt.host == "127.0.0.2" {
+				listener, err := net.Listen("tcp", "127.0.0.2:0")
+				if err != nil {
+					t.Skipf("no second loopback address for the remote host: %v", err)
+				}
+				listener.Close()
+				address = "127.0.0.2:0"
+			}
+			s := startSMTPServerOn(t, address, smtpServerOptions{
+				starttls:    tt.tlsMode == "starttls",
+				implicitTLS: tt.tlsMode == "implicit",
+				users:       map[string]string{"user": "secret"},
+				mechanisms:  []string{"PLAIN"},
+			})
+			config := serverConfig(s, map[string]any{
+				"host":           tt.host,
+				"authentication": true,
+				"username":       "user",
+				"password":       "secret",
+				"tls_mode":       tt.tlsMode,
+				"ca_cert_pem":    s.caPEM,
+			})
+			for name, value := range tt.config {
+				config[name] = value
+			}
+			p := newProviderTest(t, config)
+			result := p.create("smtp_send_mail", map[string]any{
+				"to":      []string{"alice@example.com"},
+				"subject": "Hello",
+				"body":    "Hello Alice",
+			})
+
+			if tt.wantErr != "" {
+				if err := diagnosticsError(result.diags); !strings.Contains(err, tt.wantErr) {
+					t.Errorf("expected an error containing %q, got %q", tt.wantErr, err)
+				}
+				if slices.Contains(s.Verbs(), "AUTH") {
+					t.Errorf("expected the credentials not to be sent, got %q", s.Commands())
+				}
+				return
+			}
+			result.mustApply(t)
+			if m := s.Messages()[0]; m.user != "user" || m.tls != (tt.tlsMode != "none") {
+				t.Errorf("expected the message to be sent as user with tls %t, got %q with tls %t", tt.tlsMode != "none", m.user, m.tls)
+			}
+		})
+	}
+}
+
+func TestExternalAuth(t *testing.T) {
+	certPEM, keyPEM := newClientCertificate(t)
+
+	tests := []struct {
+		name        string
+		identity    any
+		wantCommand string
+		wantUser    string
+	}{
+		{name: "empty identity", wantCommand: "AUTH EXTERNAL =", wantUser: "external"},
+		{name: "identity", identity: "alice", wantCommand: "AUTH EXTERNAL YWxpY2U=", wantUser: "alice"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startSMTPServer(t, smtpServerOptions{starttls: true, users: map[string]string{}})
+			p := newProviderTest(t, serverConfig(s, map[string]any{
+				"authentication":  true,
+				"auth_mechanism":  "external",
+				"auth_identity":   tt.identity,
+				"tls_mode":        "starttls",
+				"ca_cert_pem":     s.caPEM,
+				"client_cert_pem": certPEM,
+				"client_key_pem":  keyPEM,
+			}))
+			p.create("smtp_send_mail", map[string]any{
+				"to":      []string{"alice@example.com"},
+				"subject": "Hello",
+				"body":    "Hello Alice",
+			}).mustApply(t)
+
+			if commands := s.Commands(); !slices.Contains(commands, tt.wantCommand) {
+				t.Errorf("expected the %q command, got %q", tt.wantCommand, commands)
+			}
+			if got := s.Messages()[0].user; got != tt.wantUser {
+				t.Errorf("expected the message to be sent as %q, got %q", tt.wantUser, got)
+			}
+		})
+	}
+}
+
+// newClientCertificate generates a self-signed client certificate, returning
+// the certificate and key PEM.
+func newClientCertificate(t *testing.T) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating the client key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating the client certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("encoding the client key: %v", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}))
+}
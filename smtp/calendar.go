@@ -0,0 +1,104 @@
+package smtp
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// calendarMethods lists the supported iTIP methods of the calendar invite.
+var calendarMethods = []string{"REQUEST", "CANCEL", "REPLY"}
+
+// calendarInvite is an RFC 5545 meeting request, cancellation or reply sent
+// along with the body.
+type calendarInvite struct {
+	// method is the iTIP method, one of calendarMethods.
+	method string
+	uid    string
+	// sequence is the revision of the event, incremented when an invite is
+	// sent again with the same uid so that it updates the calendar entry.
+	sequence  int64
+	summary   string
+	location  string
+	organizer string
+	attendees []string
+	start     time.Time
+	end       time.Time
+}
+
+// calendarTimeFormat is the iCalendar UTC date-time format.
+const calendarTimeFormat = "20060102T150405Z"
+
+// bytes returns the VCALENDAR object of the invite, with a single VEVENT.
+func (i *calendarInvite) bytes(stamp time.Time) []byte {
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//terraform-provider-smtp//EN",
+		"METHOD:" + i.method,
+		"BEGIN:VEVENT",
+		"UID:" + escapeCalendarText(i.uid),
+		"DTSTAMP:" + stamp.UTC().Format(calendarTimeFormat),
+		"DTSTART:" + i.start.UTC().Format(calendarTimeFormat),
+		"DTEND:" + i.end.UTC().Format(calendarTimeFormat),
+		"SUMMARY:" + escapeCalendarText(i.summary),
+	}
+	if i.location != "" {
+		lines = append(lines, "LOCATION:"+escapeCalendarText(i.location))
+	}
+	lines = append(lines, "ORGANIZER:mailto:"+i.organizer)
+	for _, attendee := range i.attendees {
+		// A reply is sent by the attendees accepting the invite.
+		if i.method == "REPLY" {
+			lines = append(lines, "ATTENDEE;PARTSTAT=ACCEPTED:mailto:"+attendee)
+		} else {
+			lines = append(lines, "ATTENDEE;ROLE=REQ-PARTICIPANT;PARTSTAT=NEEDS-ACTION;RSVP=TRUE:mailto:"+attendee)
+		}
+	}
+	status := "CONFIRMED"
+	if i.method == "CANCEL" {
+		status = "CANCELLED"
+	}
+	lines = append(lines,
+		"SEQUENCE:"+strconv.FormatInt(i.sequence, 10),
+		"STATUS:"+status,
+		"END:VEVENT",
+		"END:VCALENDAR",
+	)
+
+	var calendar strings.Builder
+	for _, line := range lines {
+		calendar.WriteString(foldCalendarLine(line))
+	}
+	return []byte(calendar.String())
+}
+
+// escapeCalendarText escapes the RFC 5545 TEXT value special characters.
+func escapeCalendarText(text string) string {
+	return strings.NewReplacer(
+		`\`, `\\`,
+		";", `\;`,
+		",", `\,`,
+		"\r\n", `\n`,
+		"\n", `\n`,
+	).Replace(text)
+}
+
+// foldCalendarLine folds the content line in lines of at most 75 octets, the
+// continuation lines starting with a space, without splitting UTF-8 sequences.
+func foldCalendarLine(line string) string {
+	var folded strings.Builder
+	width := 75
+	for len(line) > width {
+		cut := width
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		folded.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+		// The leading space counts in the continuation lines.
+		width = 74
+	}
+	folded.WriteString(line + "\r\n")
+	return folded.String()
+}
@@ -0,0 +1,1319 @@
+package smtp
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+	"golang.org/x/net/idna"
+	"golang.org/x/net/proxy"
+)
+
+// sendError wraps an error raised while talking to the SMTP server with the
+// summary to surface in the diagnostics.
+type sendError struct {
+	summary string
+	err     error
+}
+
+func (e *sendError) Error() string {
+	return e.summary + " " + e.err.Error()
+}
+
+func (e *sendError) Unwrap() error {
+	return e.err
+}
+
+// enhancedStatusCode matches the RFC 3463 enhanced status code at the start of
+// an SMTP reply text.
+var enhancedStatusCode = regexp.MustCompile(`^[245]\.\d{1,3}\.\d{1,3}\b`)
+
+// diagnostic returns the summary and detail of the diagnostic reporting the
+// error. The summary is prefixed with the category of the error, eg.
+// [rcpt_rejected]. When the server replied with an error, its reply code and
+// enhanced status code are included in the summary.
+func (e *sendError) diagnostic() (string, string) {
+	summary := "[" + errorCategory(e.summary, e.err) + "] " + e.summary
+	var replyErr *textproto.Error
+	if !errors.As(e.err, &replyErr) {
+		return summary, e.err.Error()
+	}
+
+	code := strconv.Itoa(replyErr.Code)
+	text := replyErr.Msg
+	if enhanced := enhancedStatusCode.FindString(text); enhanced != "" {
+		code += " " + enhanced
+		text = strings.TrimSpace(strings.TrimPrefix(text, enhanced))
+	}
+	// The context wrapped after the reply, eg. the greylist retries, is kept.
+	detail := "The SMTP server replied " + code + ": " + text
+	if rest, ok := strings.CutPrefix(e.err.Error(), replyErr.Error()); ok {
+		detail += rest
+	}
+	return summary + " SMTP " + code, detail
+}
+
+// errorCategory classifies the send error with the given summary into one of
+// the stable categories scripts can branch on: connection, tls, auth,
+// rcpt_rejected, data_rejected or timeout.
+func errorCategory(summary string, err error) string {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+	if isTLSError(err) {
+		return "tls"
+	}
+	if isDropped(err) {
+		return "connection"
+	}
+
+	switch summary {
+	case "Error connecting to SMTP server:", "Error ending SMTP session:":
+		return "connection"
+	case "Error upgrading connection to TLS:":
+		return "tls"
+	case "Error authenticating with SMTP server:":
+		return "auth"
+	case "Error setting recipient address:", "Error verifying recipient addresses:":
+		return "rcpt_rejected"
+	case "Error waiting for the SMTP send rate limit:":
+		return "timeout"
+	}
+	return "data_rejected"
+}
+
+// isTLSError reports whether the error was raised by the TLS handshake or the
+// verification of the server certificate.
+func isTLSError(err error) bool {
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var verifyErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	return errors.As(err, &recordErr) ||
+		errors.As(err, &alertErr) ||
+		errors.As(err, &verifyErr) ||
+		errors.As(err, &authorityErr) ||
+		errors.As(err, &hostnameErr) ||
+		errors.As(err, &invalidErr)
+}
+
+// envelope describes a single SMTP transaction.
+type envelope struct {
+	from string
+	to   []string
+	msg  []byte
+	// dryRun stops the transaction before DATA, resetting it instead.
+	dryRun bool
+	// continueOnRcptError sends the message to the accepted recipients when
+	// some of them are rejected.
+	continueOnRcptError bool
+	// verp sends the message to each recipient in its own transaction, with
+	// an envelope sender encoding the recipient address.
+	verp bool
+	// credentials override the provider credentials when set.
+	credentials *credentials
+	// dsn requests delivery status notifications when set.
+	dsn *dsn
+	// msg7bit is the message with its 8-bit body quoted-printable encoded,
+	// sent instead of msg to the servers that do not advertise 8BITMIME. It is
+	// only set when msg has 8-bit content.
+	msg7bit []byte
+	// requireTLS fails the send when the session cannot be upgraded to TLS,
+	// whatever the provider tls_mode.
+	requireTLS bool
+	// verifyRecipients checks all the recipients are accepted before sending
+	// the message to any of them.
+	verifyRecipients bool
+}
+
+// dsn holds the RFC 3461 delivery status notification parameters.
+type dsn struct {
+	// notify lists the NOTIFY conditions of the recipients, eg. SUCCESS.
+	notify []string
+	// ret is the RET parameter, FULL or HDRS.
+	ret string
+	// envid is the ENVID parameter, returned in the notifications.
+	envid string
+}
+
+// credentials authenticate a session with the SMTP server.
+type credentials struct {
+	username, password string
+}
+
+// credentialsFor returns the credentials the envelope is sent with, or nil
+// when the session is not authenticated.
+func (c *client) credentialsFor(env envelope) *credentials {
+	if env.credentials != nil {
+		return env.credentials
+	}
+	if !c.authentication {
+		return nil
+	}
+	return &credentials{username: c.username, password: c.password}
+}
+
+// errAllRejected is returned when the server rejects all the recipients of a
+// transaction.
+var errAllRejected = errors.New("all the recipients were rejected by the server")
+
+// dial connects to the SMTP server, going through the configured proxy if any.
+// In implicit TLS mode, the connection is wrapped in TLS right away, the
+// handshake being bounded by the TLS timeout, or else the greeting timeout.
+// It also returns the network connection, on which the deadlines of the
+// session are set.
+func (c *client) dial(host string) (*smtp.Client, net.Conn, error) {
+	raw, err := c.dialConn(host)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conn := raw
+	if c.tlsMode == "implicit" {
+		tlsConn := tls.Client(raw, c.tlsConfigFor(c.serverName(host)))
+		timeout := c.tlsTimeout
+		if timeout == 0 {
+			timeout = c.greetingTimeout
+		}
+		setDeadline(raw, timeout)
+		err := tlsConn.Handshake()
+		setDeadline(raw, 0)
+		if err != nil {
+			raw.Close()
+			return nil, nil, c.tlsError(err)
+		}
+		conn = tlsConn
+	}
+	session, err := c.greet(conn, host)
+	if err != nil {
+		return nil, nil, err
+	}
+	return session, raw, nil
+}
+
+// tlsError reports the failed TLS handshake, which a server only offering TLS
+// versions older than min_tls_version also fails.
+func (c *client) tlsError(err error) error {
+	return &sendError{"Error upgrading connection to TLS:", fmt.Errorf("%w (minimum TLS version allowed is %s)", err, c.minTLSVersion)}
+}
+
+// noSTARTTLSError reports the session cannot be upgraded to TLS as required,
+// the server not offering STARTTLS.
+func noSTARTTLSError(requireTLS bool) error {
+	reason := "which the starttls tls_mode requires to send the credentials or the client certificate"
+	if requireTLS {
+		reason = "which require_tls requires"
+	}
+	return &sendError{"Error upgrading connection to TLS:", errors.New("the SMTP server does not offer STARTTLS, " + reason)}
+}
+
+// dialConn opens the network connection with the SMTP server, going through
+// the configured proxy if any, within the connect timeout when set.
+func (c *client) dialConn(host string) (net.Conn, error) {
+	network, address := c.address(host)
+	if c.dialer == nil {
+		return net.DialTimeout(network, address, c.connectTimeout)
+	}
+	if dialer, ok := c.dialer.(proxy.ContextDialer); ok && c.connectTimeout > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), c.connectTimeout)
+		defer cancel()
+		return dialer.DialContext(ctx, network, address)
+	}
+	return c.dialer.Dial(network, address)
+}
+
+// setDeadline bounds the exchanges over the connection that follow by the
+// timeout, or lifts the deadline when the timeout is 0. The connection may be
+// nil, for sessions the client did not dial.
+func setDeadline(conn net.Conn, timeout time.Duration) {
+	if conn == nil {
+		return
+	}
+	if timeout == 0 {
+		conn.SetDeadline(time.Time{})
+		return
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+}
+
+// greet starts the SMTP session over the connection. The greeting of the
+// server, and the TLS handshake in implicit mode, must be read within the
+// greeting timeout when set.
+func (c *client) greet(conn net.Conn, host string) (*smtp.Client, error) {
+	if c.greetingTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(c.greetingTimeout))
+	}
+	client, err := smtp.NewClient(conn, c.serverName(host))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+	return client, nil
+}
+
+// address returns the network and address the host is dialed on. With the unix
+// transport, the host is the path of the socket.
+func (c *client) address(host string) (string, string) {
+	if c.transport == "unix" {
+		return "unix", host
+	}
+	return "tcp", net.JoinHostPort(host, c.port)
+}
+
+// serverName returns the name the host is known by for TLS and authentication.
+// Unix sockets are always local, so their server is the localhost.
+func (c *client) serverName(host string) string {
+	if c.transport == "unix" {
+		return "localhost"
+	}
+	return host
+}
+
+// delivery reports the outcome of a send.
+type delivery struct {
+	// host is the SMTP host that accepted the last batch of recipients.
+	host string
+	// batches is the number of transactions the recipients were split into.
+	batches int
+	// rejected lists the recipients refused by the server.
+	rejected []rejection
+	// accepted lists the recipients accepted by the server.
+	accepted []string
+	// senders maps the recipients to their VERP envelope senders.
+	senders map[string]string
+	// quitErr reports the sessions that did not end gracefully.
+	quitErr error
+	// dsnIgnored reports the DSN parameters were not sent by some transaction.
+	dsnIgnored bool
+	// insecureAuth reports the credentials were sent unencrypted.
+	insecureAuth bool
+	// responses lists the final replies of the server to the transactions.
+	responses []string
+	// negotiated reports the features of the session of the last batch.
+	negotiated negotiation
+}
+
+// transaction reports the outcome of a single mail transaction.
+type transaction struct {
+	// host is the SMTP host the transaction was run with.
+	host     string
+	rejected []rejection
+	accepted []string
+	// dsnIgnored reports the DSN parameters were not sent as the server does
+	// not advertise the extension.
+	dsnIgnored bool
+	// insecureAuth reports the session was authenticated unencrypted.
+	insecureAuth bool
+	// response is the final reply of the server to the message, eg. with the
+	// queue id the server assigned to it.
+	response string
+	// contentSent reports the content of the message was written, after
+	// which the server may have delivered it even without replying.
+	contentSent bool
+	// negotiated reports the features of the session the transaction was
+	// run with.
+	negotiated negotiation
+}
+
+// negotiation reports how the provider adapted to the server for a
+// transaction, from the EHLO reply of the session and the commands sent.
+type negotiation struct {
+	tls bool
+	// authMechanism is empty when the session is not authenticated.
+	authMechanism string
+	// sizeLimit is zero when the server does not advertise a limit.
+	sizeLimit int64
+	smtputf8  bool
+	chunking  bool
+}
+
+// negotiate reports the features of the session the transaction of the
+// envelope was run with.
+func (c *client) negotiate(conn *smtp.Client, creds *credentials, env envelope) negotiation {
+	var n negotiation
+	_, n.tls = conn.TLSConnectionState()
+	if creds != nil {
+		n.authMechanism, _ = c.resolveAuthMechanism(conn)
+	}
+	if ok, param := conn.Extension("SIZE"); ok {
+		n.sizeLimit, _ = strconv.ParseInt(param, 10, 64)
+	}
+	n.smtputf8, _ = conn.Extension("SMTPUTF8")
+	n.chunking = c.useChunking(conn) && !env.dryRun
+	return n
+}
+
+// rejection records a recipient refused by the server along with its reply.
+type rejection struct {
+	recipient string
+	reply     string
+}
+
+// send delivers the message, splitting the recipients into batches of at most
+// maxRecipients when the limit is set, or of a single recipient with VERP.
+// Each batch is a separate transaction with the full message, sent over the
+// shared session with the host. When rejections are tolerated, a batch whose
+// recipients are all rejected does not stop the others.
+//
+// The sessions are shared with the concurrent sends, and ended with QUIT once
+// the last of them is done unless the connections are reused for the run.
+func (c *client) send(ctx context.Context, env envelope) (result delivery, err error) {
+	c.acquire()
+	defer func() {
+		result.quitErr = c.release(ctx)
+	}()
+
+	env.to = c.withArchiveBcc(env.to)
+
+	size := c.maxRecipients
+	if env.verp && len(env.to) > 1 {
+		size = 1
+		result.senders = map[string]string{}
+	}
+
+	batches := batchRecipients(env.to, size)
+	if env.verifyRecipients && !env.dryRun {
+		if err := c.verifyRecipients(ctx, env, batches); err != nil {
+			return result, err
+		}
+	}
+
+	var failed error
+	for _, to := range batches {
+		// Wait for the rate limit rather than be throttled by the relay.
+		if c.limiter != nil {
+			if err := c.limiter.Wait(ctx); err != nil {
+				return result, &sendError{"Error waiting for the SMTP send rate limit:", err}
+			}
+		}
+
+		batch := env
+		batch.to = to
+		if result.senders != nil {
+			batch.from = verpAddress(env.from, to[0])
+			result.senders[to[0]] = batch.from
+		}
+
+		tx, err := c.sendGreylisted(ctx, batch)
+		result.rejected = append(result.rejected, tx.rejected...)
+		if err != nil {
+			if env.continueOnRcptError && errors.Is(err, errAllRejected) {
+				failed = err
+				continue
+			}
+			return result, err
+		}
+		result.host = tx.host
+		result.batches++
+		result.accepted = append(result.accepted, tx.accepted...)
+		result.dsnIgnored = result.dsnIgnored || tx.dsnIgnored
+		result.insecureAuth = result.insecureAuth || tx.insecureAuth
+		result.negotiated = tx.negotiated
+		if tx.response != "" {
+			result.responses = append(result.responses, tx.response)
+		}
+	}
+	if result.batches == 0 && failed != nil {
+		return result, failed
+	}
+	return result, nil
+}
+
+// withArchiveBcc returns the recipients along with the provider archive_bcc
+// addresses that are not already among them. Only the envelope is changed,
+// so the archive addresses never appear in the headers.
+func (c *client) withArchiveBcc(to []string) []string {
+	recipients := append([]string{}, to...)
+	seen := map[string]bool{}
+	for _, addr := range to {
+		seen[normalizeAddress(addr)] = true
+	}
+	for _, addr := range c.archiveBcc {
+		if !seen[normalizeAddress(addr)] {
+			recipients = append(recipients, addr)
+			seen[normalizeAddress(addr)] = true
+		}
+	}
+	return recipients
+}
+
+// verifyRecipients checks the recipients of each batch are accepted by the
+// server in a dry transaction, reset instead of sent, so that the message is
+// not sent to some of the recipients when another one is rejected.
+func (c *client) verifyRecipients(ctx context.Context, env envelope, batches [][]string) error {
+	var rejected []string
+	for _, to := range batches {
+		verify := env
+		verify.to, verify.dryRun, verify.continueOnRcptError = to, true, true
+		tx, err := c.sendFailover(ctx, verify)
+		for _, rejection := range tx.rejected {
+			rejected = append(rejected, rejection.recipient+": "+rejection.reply)
+		}
+		if err != nil && !errors.Is(err, errAllRejected) {
+			return err
+		}
+	}
+	if len(rejected) > 0 {
+		return &sendError{"Error verifying recipient addresses:", fmt.Errorf("the email was not sent as the server rejected %d of the recipients: %s", len(rejected), strings.Join(rejected, "; "))}
+	}
+	return nil
+}
+
+// verpAddress returns the VERP envelope sender of the recipient, eg.
+// bounces+user=example.com@our.tld for the bounces@our.tld sender and the
+// user@example.com recipient.
+func verpAddress(from, to string) string {
+	at := strings.LastIndex(from, "@")
+	if at < 0 {
+		return from
+	}
+	return from[:at] + "+" + strings.Replace(to, "@", "=", 1) + from[at:]
+}
+
+// batchRecipients splits the recipients into batches of at most size
+// recipients. A size of zero means no limit.
+func batchRecipients(to []string, size int) [][]string {
+	if size <= 0 || len(to) <= size {
+		return [][]string{to}
+	}
+
+	var batches [][]string
+	for len(to) > size {
+		batches = append(batches, to[:size])
+		to = to[size:]
+	}
+	return append(batches, to)
+}
+
+// sendGreylisted delivers the message, sending it again while the server
+// greylists it, up to greylistRetries times. The delay between the retries
+// starts at greylistDelay and doubles, bounded by greylistMaxWait overall. The
+// failed session is closed, so each retry runs over a new connection.
+func (c *client) sendGreylisted(ctx context.Context, env envelope) (transaction, error) {
+	delay, waited := c.greylistDelay, time.Duration(0)
+	for retry := 1; ; retry++ {
+		tx, err := c.sendFailover(ctx, env)
+		if c.greylistRetries == 0 || !isGreylisted(tx, err) {
+			return tx, err
+		}
+		if retry > c.greylistRetries {
+			return tx, explainGreylisting(err, fmt.Sprintf("the email was still greylisted after %d retries, apply again later or raise greylist_retry", c.greylistRetries))
+		}
+		if waited+delay > c.greylistMaxWait {
+			return tx, explainGreylisting(err, fmt.Sprintf("the email was greylisted and retrying in %s would wait past the greylist_max_wait of %s, apply again later or raise greylist_max_wait", delay, c.greylistMaxWait))
+		}
+
+		tflog.Info(ctx, "Email greylisted by the SMTP server, retrying", map[string]any{"retry": retry, "delay": delay.String(), "error": err.Error()})
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return tx, &sendError{"Error waiting to retry the greylisted email:", ctx.Err()}
+		case <-timer.C:
+		}
+		waited += delay
+		delay *= 2
+	}
+}
+
+// explainGreylisting appends the explanation to the error of the greylisted
+// transaction, keeping its summary and thus its category.
+func explainGreylisting(err error, explanation string) error {
+	var sendErr *sendError
+	if errors.As(err, &sendErr) {
+		return &sendError{sendErr.summary, fmt.Errorf("%w; %s", sendErr.err, explanation)}
+	}
+	return fmt.Errorf("%w; %s", err, explanation)
+}
+
+// isGreylisted reports whether the server greylisted the transaction, that is
+// temporarily rejected it with a 450 or 451 reply. When the rejections are
+// tolerated, all the recipients must have been rejected so.
+func isGreylisted(tx transaction, err error) bool {
+	if errors.Is(err, errAllRejected) && len(tx.rejected) > 0 {
+		for _, rejection := range tx.rejected {
+			if !strings.HasPrefix(rejection.reply, "450 ") && !strings.HasPrefix(rejection.reply, "451 ") {
+				return false
+			}
+		}
+		return true
+	}
+
+	var replyErr *textproto.Error
+	return errors.As(err, &replyErr) && (replyErr.Code == 450 || replyErr.Code == 451)
+}
+
+// isPermanent reports whether the send failed with a permanent (5xx) reply,
+// including when every recipient was rejected with one under
+// continue_on_rcpt_error.
+func isPermanent(tx transaction, err error) bool {
+	if errors.Is(err, errAllRejected) && len(tx.rejected) > 0 {
+		for _, rejection := range tx.rejected {
+			if !strings.HasPrefix(rejection.reply, "5") {
+				return false
+			}
+		}
+		return true
+	}
+
+	var replyErr *textproto.Error
+	return errors.As(err, &replyErr) && replyErr.Code >= 500
+}
+
+// sendFailover delivers the message, trying each configured host in order
+// until one accepts it. Permanent (5xx) rejections stop the failover since
+// another host would reject it as well.
+func (c *client) sendFailover(ctx context.Context, env envelope) (transaction, error) {
+	var tx transaction
+	var err error
+	for _, host := range c.hosts {
+		tx, err = c.sendVia(ctx, host, env)
+		if err == nil {
+			return tx, nil
+		}
+
+		if isPermanent(tx, err) {
+			break
+		}
+		// Without a reply to its content, the message may have been
+		// delivered, so it is not sent through the next host.
+		var replyErr *textproto.Error
+		if tx.contentSent && !errors.As(err, &replyErr) {
+			break
+		}
+		tflog.Warn(ctx, "Failed to send email", map[string]any{"smtp_host": host, "error": err.Error()})
+	}
+	return tx, err
+}
+
+// sendVia delivers the message through a single SMTP host. Sessions are
+// shared between sends to the same host; when a shared session has been
+// dropped by the server, the message is sent over a fresh connection.
+func (c *client) sendVia(ctx context.Context, host string, env envelope) (transaction, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	creds := c.credentialsFor(env)
+	tx := transaction{host: host}
+	conn, reused, err := c.session(ctx, host, creds, env.requireTLS)
+	if err != nil {
+		return tx, err
+	}
+	tx.insecureAuth = !reused && c.sentInsecureAuth(conn, creds)
+
+	err = c.transact(ctx, conn, env, &tx)
+	if err == nil {
+		c.idleSince[c.sessionKey(host, creds)] = time.Now()
+		tx.negotiated = c.negotiate(conn, creds, env)
+		return tx, nil
+	}
+
+	// Never reuse a session that failed mid-transaction.
+	c.closeSession(host, creds)
+
+	if !reused || !isDropped(err) {
+		return tx, err
+	}
+
+	// Once its content is written, the message may have been delivered
+	// before the session dropped, so it is never sent again.
+	if tx.contentSent {
+		return tx, err
+	}
+
+	tflog.Debug(ctx, "Shared SMTP session was dropped, reconnecting", map[string]any{"smtp_host": host, "error": err.Error()})
+	tx = transaction{host: host}
+	conn, _, err = c.session(ctx, host, creds, env.requireTLS)
+	if err != nil {
+		return tx, err
+	}
+	tx.insecureAuth = c.sentInsecureAuth(conn, creds)
+	err = c.transact(ctx, conn, env, &tx)
+	if err != nil {
+		c.closeSession(host, creds)
+	} else {
+		c.idleSince[c.sessionKey(host, creds)] = time.Now()
+		tx.negotiated = c.negotiate(conn, creds, env)
+	}
+	return tx, err
+}
+
+// session returns a session with the host authenticated with the credentials,
+// reusing the pooled one when available. When TLS is required, a pooled
+// session that is not encrypted is replaced. The caller must hold c.mu.
+func (c *client) session(ctx context.Context, host string, creds *credentials, requireTLS bool) (*smtp.Client, bool, error) {
+	key := c.sessionKey(host, creds)
+	if conn, ok := c.sessions[key]; ok {
+		_, encrypted := conn.TLSConnectionState()
+		switch {
+		case requireTLS && !encrypted:
+			// Replaced by a new session upgraded to TLS.
+		case c.idleTimeout == 0 || time.Since(c.idleSince[key]) < c.idleTimeout:
+			return conn, true, nil
+		case c.noop(conn) == nil:
+			// The idle session is still alive, the relay may have dropped it.
+			return conn, true, nil
+		}
+		c.closeSession(host, creds)
+	}
+
+	conn, err := c.connect(ctx, host, creds, requireTLS)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if c.sessions == nil {
+		c.sessions = map[string]*smtp.Client{}
+		c.idleSince = map[string]time.Time{}
+	}
+	c.sessions[key] = conn
+	return conn, false, nil
+}
+
+// noop checks the pooled session is still alive with NOOP, within the timeout
+// when set. The caller must hold c.mu.
+func (c *client) noop(conn *smtp.Client) error {
+	raw := c.netConns[conn]
+	setDeadline(raw, c.timeout)
+	defer setDeadline(raw, 0)
+	return conn.Noop()
+}
+
+// acquire marks a send as pending, so that the pooled sessions are kept until
+// the matching release.
+func (c *client) acquire() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending++
+}
+
+// release ends the pooled sessions with QUIT when no other send is pending.
+// When the connections are reused, the sessions are kept for the later sends
+// of the run instead, and session checks them with NOOP once idle.
+func (c *client) release(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pending--
+	if c.pending > 0 || c.reuseConnection {
+		return nil
+	}
+
+	var errs []error
+	for key, conn := range c.sessions {
+		setDeadline(c.netConns[conn], c.timeout)
+		if err := conn.Quit(); err != nil {
+			conn.Close()
+			errs = append(errs, err)
+		}
+		delete(c.netConns, conn)
+		delete(c.sessions, key)
+		delete(c.idleSince, key)
+	}
+	if len(errs) > 0 {
+		tflog.Warn(ctx, "Failed to end SMTP session gracefully", map[string]any{"error": errors.Join(errs...).Error()})
+	}
+	return errors.Join(errs...)
+}
+
+// closeSession drops the pooled session with the host. The caller must hold c.mu.
+func (c *client) closeSession(host string, creds *credentials) {
+	key := c.sessionKey(host, creds)
+	if conn, ok := c.sessions[key]; ok {
+		conn.Close()
+		delete(c.netConns, conn)
+		delete(c.sessions, key)
+		delete(c.idleSince, key)
+	}
+}
+
+// sentInsecureAuth reports whether the credentials were sent over the session
+// unencrypted without being allowed to.
+func (c *client) sentInsecureAuth(conn *smtp.Client, creds *credentials) bool {
+	_, encrypted := conn.TLSConnectionState()
+	return creds != nil && !encrypted && !c.allowInsecureAuth
+}
+
+// sessionKey identifies the pooled sessions by host, port and credentials, so
+// that a session is never shared with other credentials. The key is never
+// logged.
+func (c *client) sessionKey(host string, creds *credentials) string {
+	_, address := c.address(host)
+	if creds == nil {
+		return address + "/"
+	}
+	return address + "/" + creds.username + "\x00" + creds.password
+}
+
+// connect opens a new session with the host, upgrading it to TLS and
+// authenticating with the credentials when set. When TLS is required, the
+// session is upgraded whatever the tls_mode. Each step runs within its own
+// timeout when set, and the network connection is kept in c.netConns for the
+// deadlines of the later commands. The caller must hold c.mu.
+func (c *client) connect(ctx context.Context, host string, creds *credentials, requireTLS bool) (*smtp.Client, error) {
+	// Connect to the SMTP server, using TLS from the start in implicit mode.
+	conn, raw, err := c.dial(host)
+	var tlsErr *sendError
+	if errors.As(err, &tlsErr) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, &sendError{"Error connecting to SMTP server:", err}
+	}
+	setDeadline(raw, c.timeout)
+
+	// Upgrade the connection to TLS. Implicit TLS connections are already
+	// encrypted and would fail StartTLS, so they are authenticated right away.
+	if c.tlsMode != "implicit" && (requireTLS || c.tlsMode == "starttls" && (creds != nil || len(c.tlsConfig.Certificates) > 0)) {
+		if ok, _ := conn.Extension("STARTTLS"); !ok {
+			conn.Close()
+			return nil, noSTARTTLSError(requireTLS)
+		}
+		setDeadline(raw, c.tlsTimeout)
+		err = conn.StartTLS(c.tlsConfigFor(c.serverName(host)))
+		if err != nil {
+			conn.Close()
+			return nil, c.tlsError(err)
+		}
+	}
+
+	// Authenticate with the SMTP server, warning when the credentials are
+	// about to be sent in the clear unless explicitly allowed.
+	if creds != nil {
+		_, encrypted := conn.TLSConnectionState()
+		if !encrypted && !c.allowInsecureAuth {
+			tflog.Warn(ctx, "Sending SMTP credentials over an unencrypted connection", map[string]any{"smtp_host": host})
+		}
+
+		// The stdlib checks the host of PlainAuth against the name the session
+		// was started with, which is also the TLS server name.
+		setDeadline(raw, c.authTimeout)
+		auth, err := c.newAuth(conn, c.serverName(host), creds)
+		if err == nil {
+			if !encrypted && c.allowInsecureAuth {
+				auth = insecureAuth{auth}
+			}
+			err = conn.Auth(auth)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, &sendError{"Error authenticating with SMTP server:", explainAuthRefusal(err)}
+		}
+	}
+
+	setDeadline(raw, 0)
+	if c.netConns == nil {
+		c.netConns = map[*smtp.Client]net.Conn{}
+	}
+	c.netConns[conn] = raw
+	return conn, nil
+}
+
+// latency reports how long the steps of a probe session took.
+type latency struct {
+	connect, tlsHandshake, total time.Duration
+}
+
+// probe opens a session with the host as connect does, without authenticating,
+// and ends it with QUIT. It times the connection, the TLS handshake if any, and
+// the whole session. The session runs within the timeout, or within
+// defaultProbeTimeout when none is set.
+func (c *client) probe(host string) (latency, error) {
+	var l latency
+	timeout := c.timeout
+	if timeout == 0 {
+		timeout = defaultProbeTimeout
+	}
+
+	start := time.Now()
+	conn, err := c.dialConn(host)
+	if err != nil {
+		return l, &sendError{"Error connecting to SMTP server:", err}
+	}
+	l.connect = time.Since(start)
+	setDeadline(conn, timeout)
+
+	if c.tlsMode == "implicit" {
+		tlsConn := tls.Client(conn, c.tlsConfigFor(c.serverName(host)))
+		if c.tlsTimeout > 0 {
+			setDeadline(conn, c.tlsTimeout)
+		} else if c.greetingTimeout > 0 {
+			setDeadline(conn, c.greetingTimeout)
+		}
+		handshakeStart := time.Now()
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return l, c.tlsError(err)
+		}
+		l.tlsHandshake = time.Since(handshakeStart)
+		conn = tlsConn
+	}
+
+	session, err := c.greet(conn, host)
+	if err != nil {
+		return l, &sendError{"Error connecting to SMTP server:", err}
+	}
+	defer session.Close()
+	// The greeting lifts the read deadline once received.
+	setDeadline(conn, timeout)
+
+	// The STARTTLS round trip is timed along with the handshake. As when
+	// sending, the session must be upgraded to authenticate or to present the
+	// client certificate, which fails when the server does not offer STARTTLS.
+	if c.tlsMode == "starttls" {
+		offered, _ := session.Extension("STARTTLS")
+		if !offered && (c.authentication || len(c.tlsConfig.Certificates) > 0) {
+			return l, noSTARTTLSError(false)
+		}
+		if offered {
+			if c.tlsTimeout > 0 {
+				setDeadline(conn, c.tlsTimeout)
+			}
+			handshakeStart := time.Now()
+			if err := session.StartTLS(c.tlsConfigFor(c.serverName(host))); err != nil {
+				return l, c.tlsError(err)
+			}
+			l.tlsHandshake = time.Since(handshakeStart)
+			setDeadline(conn, timeout)
+		}
+	}
+
+	if err := session.Quit(); err != nil {
+		return l, &sendError{"Error ending SMTP session:", err}
+	}
+	l.total = time.Since(start)
+	return l, nil
+}
+
+// isDropped reports whether the error means the server closed the session.
+func isDropped(err error) bool {
+	var replyErr *textproto.Error
+	if errors.As(err, &replyErr) {
+		return replyErr.Code == 421
+	}
+
+	var netErr net.Error
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.As(err, &netErr)
+}
+
+// transact runs a single mail transaction over an established session,
+// recording its outcome in tx. When enabled and advertised by the server, the
+// commands are pipelined. The commands run within the timeout when set, and
+// the email content within the data timeout.
+func (c *client) transact(ctx context.Context, conn *smtp.Client, env envelope, tx *transaction) error {
+	raw := c.netConns[conn]
+	setDeadline(raw, c.timeout)
+	defer setDeadline(raw, 0)
+
+	var params []string
+
+	// Declare the 8-bit content with BODY=8BITMIME, or fall back to the 7-bit
+	// message when the server does not advertise the extension.
+	if !isASCII(string(env.msg)) {
+		if ok, _ := conn.Extension("8BITMIME"); ok {
+			params = append(params, "BODY=8BITMIME")
+		} else if env.msg7bit != nil {
+			env.msg = env.msg7bit
+		}
+	}
+
+	// Fail fast when the server advertises a smaller maximum message size.
+	if ok, param := conn.Extension("SIZE"); ok {
+		size := len(env.msg)
+		if limit, err := strconv.Atoi(param); err == nil && limit > 0 && size > limit {
+			return &sendError{"Error email exceeds the SMTP server size limit:", fmt.Errorf("the email is %d bytes but the server accepts at most %d bytes", size, limit)}
+		}
+		params = append(params, "SIZE="+strconv.Itoa(size))
+	}
+
+	// Check all the addresses can be sent before starting the transaction.
+	from, err := envelopeAddress(conn, env.from)
+	if err != nil {
+		return &sendError{"Error setting sender address:", err}
+	}
+	to := make([]string, len(env.to))
+	for i, receiver := range env.to {
+		to[i], err = envelopeAddress(conn, receiver)
+		if err != nil {
+			return &sendError{"Error setting recipient address:", err}
+		}
+	}
+
+	var rcptParams []string
+	if env.dsn != nil {
+		if ok, _ := conn.Extension("DSN"); ok {
+			params, rcptParams = append(params, env.dsn.mailParams()...), env.dsn.rcptParams()
+		} else {
+			tx.dsnIgnored = true
+		}
+	}
+
+	// The replies of the pipelined commands are read along with the email
+	// content, so the data timeout bounds the whole pipelined transaction.
+	if ok, _ := conn.Extension("PIPELINING"); ok && c.pipelining {
+		setDeadline(raw, c.dataTimeout)
+		return pipeline(ctx, conn, env, from, to, params, rcptParams, c.useChunking(conn), tx)
+	}
+
+	err = mailFrom(conn, from, params)
+	if err != nil {
+		return &sendError{"Error setting sender address:", err}
+	}
+	accepted := 0
+	for i, receiver := range env.to {
+		tflog.Debug(ctx, "Receiver: "+receiver)
+		ok, err := rcptReply(env, tx, receiver, rcptTo(conn, to[i], rcptParams))
+		if err != nil {
+			return err
+		}
+		if ok {
+			accepted++
+		}
+	}
+	if accepted == 0 {
+		return &sendError{"Error setting recipient address:", errAllRejected}
+	}
+
+	// Reset the transaction instead of sending the message in dry run mode.
+	if env.dryRun {
+		err = conn.Reset()
+		if err != nil {
+			return &sendError{"Error resetting the dry run transaction:", err}
+		}
+		return nil
+	}
+
+	setDeadline(raw, c.dataTimeout)
+	if c.useChunking(conn) {
+		return bdat(conn, env.msg, tx)
+	}
+
+	// DATA is run by hand rather than with conn.Data, whose writer discards
+	// the final reply of the server.
+	id, err := conn.Text.Cmd("DATA")
+	if err == nil {
+		err = readReply(conn, id, 354)
+	}
+	if err != nil {
+		return &sendError{"Error setting email message:", err}
+	}
+	return writeData(conn, env.msg, tx)
+}
+
+// pipeline runs the transaction with the RFC 2920 PIPELINING extension: the
+// MAIL, RCPT and DATA commands are written at once, and their replies read
+// afterwards. As with the synchronous transaction, the session is not reused
+// after an error, so the replies left unread do not matter.
+func pipeline(ctx context.Context, conn *smtp.Client, env envelope, from string, to []string, params, rcptParams []string, chunking bool, tx *transaction) error {
+	cmd, err := mailCommand(conn, from, params)
+	if err != nil {
+		return &sendError{"Error setting sender address:", err}
+	}
+	mailID, err := conn.Text.Cmd("%s", cmd)
+	if err != nil {
+		return &sendError{"Error setting sender address:", err}
+	}
+	rcptIDs := make([]uint, len(to))
+	for i, receiver := range to {
+		cmd, err := rcptCommand(receiver, rcptParams)
+		if err != nil {
+			return &sendError{"Error setting recipient address:", err}
+		}
+		rcptIDs[i], err = conn.Text.Cmd("%s", cmd)
+		if err != nil {
+			return &sendError{"Error setting recipient address:", err}
+		}
+	}
+	var dataID uint
+	if !env.dryRun && !chunking {
+		dataID, err = conn.Text.Cmd("DATA")
+		if err != nil {
+			return &sendError{"Error setting email message:", err}
+		}
+	}
+
+	err = readReply(conn, mailID, 250)
+	if err != nil {
+		return &sendError{"Error setting sender address:", err}
+	}
+	accepted := 0
+	for i, receiver := range env.to {
+		tflog.Debug(ctx, "Receiver: "+receiver)
+		ok, err := rcptReply(env, tx, receiver, readReply(conn, rcptIDs[i], 25))
+		if err != nil {
+			return err
+		}
+		if ok {
+			accepted++
+		}
+	}
+	if accepted == 0 {
+		return &sendError{"Error setting recipient address:", errAllRejected}
+	}
+
+	if env.dryRun {
+		err = conn.Reset()
+		if err != nil {
+			return &sendError{"Error resetting the dry run transaction:", err}
+		}
+		return nil
+	}
+
+	if chunking {
+		return bdat(conn, env.msg, tx)
+	}
+
+	err = readReply(conn, dataID, 354)
+	if err != nil {
+		return &sendError{"Error setting email message:", err}
+	}
+	return writeData(conn, env.msg, tx)
+}
+
+// writeData writes the message once DATA is accepted, and records the final
+// reply of the server in tx.
+func writeData(conn *smtp.Client, msg []byte, tx *transaction) error {
+	tx.contentSent = true
+	w := conn.Text.DotWriter()
+	_, err := w.Write(msg)
+	if err != nil {
+		return &sendError{"Error setting email message:", err}
+	}
+	err = w.Close()
+	if err == nil {
+		var code int
+		var text string
+		code, text, err = conn.Text.ReadResponse(250)
+		tx.response = fmt.Sprintf("%d %s", code, text)
+	}
+	if err != nil {
+		return &sendError{"Error sending email:", err}
+	}
+	return nil
+}
+
+// useChunking reports whether the message is sent with BDAT, when enabled and
+// the server advertises the CHUNKING extension.
+func (c *client) useChunking(conn *smtp.Client) bool {
+	ok, _ := conn.Extension("CHUNKING")
+	return ok && c.chunking
+}
+
+// bdatChunkSize is the size of the chunks the message is sent in with BDAT.
+const bdatChunkSize = 1 << 20
+
+// bdat sends the message in chunks with the RFC 3030 BDAT command, which the
+// stdlib client does not support. The message is sent as is, without the dot
+// stuffing of DATA. The reply to the last chunk is recorded in tx.
+func bdat(conn *smtp.Client, msg []byte, tx *transaction) error {
+	tx.contentSent = true
+	for {
+		chunk, last := msg, " LAST"
+		if len(msg) > bdatChunkSize {
+			chunk, last = msg[:bdatChunkSize], ""
+		}
+		msg = msg[len(chunk):]
+
+		id := conn.Text.Next()
+		conn.Text.StartRequest(id)
+		fmt.Fprintf(conn.Text.W, "BDAT %d%s\r\n", len(chunk), last)
+		conn.Text.W.Write(chunk)
+		err := conn.Text.W.Flush()
+		conn.Text.EndRequest(id)
+		var reply string
+		if err == nil {
+			reply, err = readReplyText(conn, id, 250)
+		}
+		if err != nil {
+			if last == "" {
+				return &sendError{"Error setting email message:", err}
+			}
+			return &sendError{"Error sending email:", err}
+		}
+		if last != "" {
+			tx.response = reply
+			return nil
+		}
+	}
+}
+
+// readReply reads the reply to the pipelined command with the given id.
+func readReply(conn *smtp.Client, id uint, expectCode int) error {
+	_, err := readReplyText(conn, id, expectCode)
+	return err
+}
+
+// readReplyText reads the reply to the pipelined command with the given id,
+// and returns it along with its code, eg. 250 2.0.0 Ok.
+func readReplyText(conn *smtp.Client, id uint, expectCode int) (string, error) {
+	conn.Text.StartResponse(id)
+	defer conn.Text.EndResponse(id)
+	code, text, err := conn.Text.ReadResponse(expectCode)
+	return fmt.Sprintf("%d %s", code, text), err
+}
+
+// rcptReply handles the reply to the RCPT command of the receiver, reporting
+// whether it was accepted. Rejections are recorded in tx when tolerated.
+func rcptReply(env envelope, tx *transaction, receiver string, err error) (bool, error) {
+	if err == nil {
+		tx.accepted = append(tx.accepted, receiver)
+		return true, nil
+	}
+
+	var replyErr *textproto.Error
+	if !env.continueOnRcptError || !errors.As(err, &replyErr) {
+		return false, &sendError{"Error setting recipient address:", err}
+	}
+	tx.rejected = append(tx.rejected, rejection{recipient: receiver, reply: fmt.Sprintf("%d %s", replyErr.Code, replyErr.Msg)})
+	return false, nil
+}
+
+// envelopeAddress returns the address as sent in the MAIL and RCPT commands.
+// Internationalized addresses are sent as is to the servers advertising
+// SMTPUTF8. Otherwise, their domain is punycode encoded, which is not possible
+// for a non-ASCII local part.
+func envelopeAddress(conn *smtp.Client, addr string) (string, error) {
+	if isASCII(addr) {
+		return addr, nil
+	}
+	if ok, _ := conn.Extension("SMTPUTF8"); ok {
+		return addr, nil
+	}
+
+	at := strings.LastIndex(addr, "@")
+	if at < 0 || !isASCII(addr[:at]) {
+		return "", fmt.Errorf("the address %s has a non-ASCII local part, which requires the SMTPUTF8 extension the server does not advertise", addr)
+	}
+	domain, err := idna.Lookup.ToASCII(addr[at+1:])
+	if err != nil {
+		return "", fmt.Errorf("the domain of the address %s cannot be punycode encoded: %w", addr, err)
+	}
+	return addr[:at+1] + domain, nil
+}
+
+// isASCII reports whether the string only contains ASCII characters.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// mailFrom issues the MAIL command with the given ESMTP parameters, which the
+// stdlib client does not support.
+func mailFrom(conn *smtp.Client, from string, params []string) error {
+	cmd, err := mailCommand(conn, from, params)
+	if err != nil {
+		return err
+	}
+
+	id, err := conn.Text.Cmd("%s", cmd)
+	if err != nil {
+		return err
+	}
+	return readReply(conn, id, 250)
+}
+
+// mailCommand returns the MAIL command with the given ESMTP parameters. As
+// with the stdlib client, SMTPUTF8 is sent when the server advertises it. The
+// BODY=8BITMIME parameter is only passed for the 8-bit messages.
+func mailCommand(conn *smtp.Client, from string, params []string) (string, error) {
+	if strings.ContainsAny(from, "\r\n") {
+		return "", errors.New("smtp: A line must not contain CR or LF")
+	}
+
+	cmd := "MAIL FROM:<" + from + ">"
+	if ok, _ := conn.Extension("SMTPUTF8"); ok {
+		cmd += " SMTPUTF8"
+	}
+	for _, param := range params {
+		cmd += " " + param
+	}
+	return cmd, nil
+}
+
+// rcptTo issues the RCPT command with the given ESMTP parameters, which the
+// stdlib client does not support.
+func rcptTo(conn *smtp.Client, to string, params []string) error {
+	cmd, err := rcptCommand(to, params)
+	if err != nil {
+		return err
+	}
+
+	id, err := conn.Text.Cmd("%s", cmd)
+	if err != nil {
+		return err
+	}
+	return readReply(conn, id, 25)
+}
+
+// rcptCommand returns the RCPT command with the given ESMTP parameters.
+func rcptCommand(to string, params []string) (string, error) {
+	if strings.ContainsAny(to, "\r\n") {
+		return "", errors.New("smtp: A line must not contain CR or LF")
+	}
+
+	cmd := "RCPT TO:<" + to + ">"
+	for _, param := range params {
+		cmd += " " + param
+	}
+	return cmd, nil
+}
+
+// mailParams returns the DSN parameters of the MAIL command.
+func (d *dsn) mailParams() []string {
+	var params []string
+	if d.ret != "" {
+		params = append(params, "RET="+d.ret)
+	}
+	if d.envid != "" {
+		params = append(params, "ENVID="+xtext(d.envid))
+	}
+	return params
+}
+
+// rcptParams returns the DSN parameters of the RCPT commands.
+func (d *dsn) rcptParams() []string {
+	if len(d.notify) == 0 {
+		return nil
+	}
+	return []string{"NOTIFY=" + strings.Join(d.notify, ",")}
+}
+
+// xtext encodes the value as an RFC 3461 xtext: the characters outside of the
+// printable ASCII range, "+" and "=" are hex encoded.
+func xtext(value string) string {
+	var encoded strings.Builder
+	for i := 0; i < len(value); i++ {
+		if b := value[i]; b < '!' || b > '~' || b == '+' || b == '=' {
+			fmt.Fprintf(&encoded, "+%02X", b)
+		} else {
+			encoded.WriteByte(b)
+		}
+	}
+	return encoded.String()
+}
@@ -0,0 +1,602 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"net"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-go/tfprotov6"
+)
+
+func TestEightBitMIME(t *testing.T) {
+	tests := []struct {
+		name         string
+		extensions   []string
+		body         string
+		wantParams   []string
+		wantEncoding string
+	}{
+		{
+			name:       "advertised",
+			extensions: []string{"8BITMIME"},
+			body:       "Grüße, Zoë",
+			wantParams: []string{"BODY=8BITMIME"},
+		},
+		{
+			name:         "not advertised",
+			body:         "Grüße, Zoë",
+			wantEncoding: "quoted-printable",
+		},
+		{
+			name:       "ascii body",
+			extensions: []string{"8BITMIME"},
+			body:       "Hello, Zoe",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startSMTPServer(t, smtpServerOptions{extensions: tt.extensions})
+			p := newProviderTest(t, serverConfig(s, nil))
+			p.create("smtp_send_mail", map[string]any{
+				"to":      []string{"alice@example.com"},
+				"subject": "Hello",
+				"body":    tt.body,
+			}).mustApply(t)
+
+			m := s.Messages()[0]
+			if !slices.Equal(m.params, tt.wantParams) {
+				t.Errorf("expected the MAIL parameters %q, got %q", tt.wantParams, m.params)
+			}
+			if got := readHeader(t, m.data).Get("Content-Transfer-Encoding"); got != tt.wantEncoding {
+				t.Errorf("expected the %q transfer encoding, got %q", tt.wantEncoding, got)
+			}
+			if eightBit := !isASCII(string(m.data)); eightBit != (tt.wantParams != nil) {
+				t.Errorf("expected 8-bit content only with BODY=8BITMIME, got %q", m.data)
+			}
+		})
+	}
+}
+
+func TestRequireTLS(t *testing.T) {
+	tests := []struct {
+		name     string
+		starttls bool
+		wantErr  string
+	}{
+		{name: "offered", starttls: true},
+		{name: "not offered", wantErr: "the SMTP server does not offer STARTTLS, which require_tls requires"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startSMTPServer(t, smtpServerOptions{starttls: tt.starttls})
+			p := newProviderTest(t, serverConfig(s, map[string]any{"ca_cert_pem": s.caPEM}))
+			result := p.create("smtp_send_mail", map[string]any{
+				"to":          []string{"alice@example.com"},
+				"subject":     "Hello",
+				"body":        "Hello Alice",
+				"require_tls": true,
+			})
+
+			if tt.wantErr != "" {
+				if err := diagnosticsError(result.diags); !strings.Contains(err, tt.wantErr) {
+					t.Errorf("expected an error containing %q, got %q", tt.wantErr, err)
+				}
+				if len(s.Messages()) != 0 {
+					t.Errorf("expected no message to be sent in the clear")
+				}
+				return
+			}
+			result.mustApply(t)
+			if !s.Messages()[0].tls {
+				t.Errorf("expected the message to be sent over TLS with tls_mode none")
+			}
+		})
+	}
+}
+
+func TestGreetingTimeout(t *testing.T) {
+	// The server accepts the connection but never sends its greeting.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	p := newProviderTest(t, map[string]any{
+		"host":             host,
+		"port":             port,
+		"authentication":   false,
+		"tls_mode":         "none",
+		"default_from":     "sender@example.com",
+		"greeting_timeout": "200ms",
+	})
+	start := time.Now()
+	result := p.create("smtp_send_mail", map[string]any{
+		"to":      []string{"alice@example.com"},
+		"subject": "Hello",
+		"body":    "Hello Alice",
+	})
+	if diagnosticsError(result.diags) == "" {
+		t.Errorf("expected the missing greeting to fail the send")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the send to fail within the greeting timeout, took %s", elapsed)
+	}
+
+	_, diags := configureProviderTest(t, map[string]any{"host": host, "greeting_timeout": "soon"})
+	if err := diagnosticsError(diags); !strings.Contains(err, "Invalid SMTP Greeting Timeout") {
+		t.Errorf("expected the invalid greeting timeout error, got %q", err)
+	}
+}
+
+func TestReuseConnection(t *testing.T) {
+	tests := []struct {
+		name         string
+		reuse        bool
+		wantSessions int
+		wantQuits    int
+	}{
+		{name: "reused", reuse: true, wantSessions: 1},
+		{name: "not reused", wantSessions: 2, wantQuits: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startSMTPServer(t, smtpServerOptions{})
+			p := newProviderTest(t, serverConfig(s, map[string]any{"reuse_connection": tt.reuse}))
+			mail := map[string]any{"to": []string{"alice@example.com"}, "subject": "Hello", "body": "Hello"}
+			p.create("smtp_send_mail", mail).mustApply(t)
+			p.create("smtp_send_mail", mail).mustApply(t)
+
+			var quits int
+			for _, verb := range s.Verbs() {
+				if verb == "QUIT" {
+					quits++
+				}
+			}
+			if got := s.Sessions(); got != tt.wantSessions || quits != tt.wantQuits {
+				t.Errorf("expected %d sessions ended by %d QUIT, got %d sessions and %d QUIT", tt.wantSessions, tt.wantQuits, got, quits)
+			}
+		})
+	}
+}
+
+func TestGreylistRetry(t *testing.T) {
+	tests := []struct {
+		name         string
+		greylisted   int
+		config       map[string]any
+		wantSessions int
+		wantErr      string
+	}{
+		{name: "disabled", greylisted: 1, wantSessions: 1, wantErr: "replied 451 4.7.1: Greylisted"},
+		{name: "retried", greylisted: 2, config: map[string]any{"greylist_retry": 2}, wantSessions: 3},
+		{
+			name:         "retries run out",
+			greylisted:   3,
+			config:       map[string]any{"greylist_retry": 2},
+			wantSessions: 3,
+			wantErr:      "the email was still greylisted after 2 retries",
+		},
+		{
+			name:         "past the maximum wait",
+			greylisted:   3,
+			config:       map[string]any{"greylist_retry": 2, "greylist_max_wait": "30ms"},
+			wantSessions: 2,
+			wantErr:      "retrying in 40ms would wait past the greylist_max_wait of 30ms",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startSMTPServer(t, smtpServerOptions{greylistSessions: tt.greylisted})
+			config := serverConfig(s, map[string]any{"greylist_retry_delay": "20ms"})
+			for name, value := range tt.config {
+				config[name] = value
+			}
+			p := newProviderTest(t, config)
+			result := p.create("smtp_send_mail", map[string]any{
+				"to":      []string{"alice@example.com"},
+				"subject": "Hello",
+				"body":    "Hello Alice",
+			})
+
+			err := diagnosticsError(result.diags)
+			if tt.wantErr != "" && !strings.Contains(err, tt.wantErr) || tt.wantErr == "" && err != "" {
+				t.Errorf("expected an error containing %q, got %q", tt.wantErr, err)
+			}
+			if got := s.Sessions(); got != tt.wantSessions {
+				t.Errorf("expected %d sessions, got %d", tt.wantSessions, got)
+			}
+			if wantMessages := map[bool]int{true: 0, false: 1}[tt.wantErr != ""]; len(s.Messages()) != wantMessages {
+				t.Errorf("expected %d messages, got %d", wantMessages, len(s.Messages()))
+			}
+		})
+	}
+}
+
+func TestDataTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    smtpServerOptions
+		config  map[string]any
+		wantErr string
+	}{
+		{
+			name:    "data slower than data_timeout",
+			opts:    smtpServerOptions{dataDelay: time.Second},
+			config:  map[string]any{"timeout": "10s", "data_timeout": "200ms"},
+			wantErr: "[timeout]",
+		},
+		{
+			name:    "chunks slower than data_timeout",
+			opts:    smtpServerOptions{extensions: []string{"CHUNKING"}, dataDelay: time.Second},
+			config:  map[string]any{"timeout": "10s", "data_timeout": "200ms", "use_chunking": true},
+			wantErr: "[timeout]",
+		},
+		{
+			// The data phase is bound by data_timeout alone, not by the
+			// shorter timeout of the other commands.
+			name:   "data within data_timeout",
+			opts:   smtpServerOptions{dataDelay: 500 * time.Millisecond},
+			config: map[string]any{"timeout": "200ms", "data_timeout": "5s"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startSMTPServer(t, tt.opts)
+			p := newProviderTest(t, serverConfig(s, tt.config))
+
+			start := time.Now()
+			result := p.create("smtp_send_mail", map[string]any{
+				"to":      []string{"alice@example.com"},
+				"subject": "Hello",
+				"body":    "Hello Alice",
+			})
+			elapsed := time.Since(start)
+
+			err := diagnosticsError(result.diags)
+			if tt.wantErr == "" {
+				if err != "" {
+					t.Errorf("unexpected error: %s", err)
+				}
+				return
+			}
+			if !strings.Contains(err, tt.wantErr) {
+				t.Errorf("expected an error containing %q, got %q", tt.wantErr, err)
+			}
+			if elapsed >= tt.opts.dataDelay {
+				t.Errorf("expected the send to time out before the %s reply, took %s", tt.opts.dataDelay, elapsed)
+			}
+		})
+	}
+}
+
+func TestMinTLSVersionDiagnostic(t *testing.T) {
+	for _, tlsMode := range []string{"starttls", "implicit"} {
+		t.Run(tlsMode, func(t *testing.T) {
+			s := startSMTPServer(t, smtpServerOptions{
+				starttls:      tlsMode == "starttls",
+				implicitTLS:   tlsMode == "implicit",
+				maxTLSVersion: tls.VersionTLS12,
+				users:         map[string]string{"user": "secret"},
+			})
+			p := newProviderTest(t, serverConfig(s, map[string]any{
+				"authentication":  true,
+				"username":        "user",
+				"password":        "secret",
+				"tls_mode":        tlsMode,
+				"min_tls_version": "1.3",
+				"ca_cert_pem":     s.caPEM,
+			}))
+
+			result := p.create("smtp_send_mail", map[string]any{
+				"to":      []string{"alice@example.com"},
+				"subject": "Hello",
+				"body":    "Hello Alice",
+			})
+			err := diagnosticsError(result.diags)
+			if !strings.Contains(err, "Error upgrading connection to TLS") || !strings.Contains(err, "minimum TLS version allowed is 1.3") {
+				t.Errorf("expected the minimum TLS version diagnostic, got %q", err)
+			}
+			if len(s.Messages()) != 0 {
+				t.Errorf("expected no message to be sent")
+			}
+		})
+	}
+}
+
+func TestDroppedSessionRetry(t *testing.T) {
+	tests := []struct {
+		name         string
+		opts         smtpServerOptions
+		wantMessages int
+		wantErr      bool
+	}{
+		{
+			// The idle session is dropped before the second email, which is
+			// sent again over a new session.
+			name:         "dropped before the content",
+			opts:         smtpServerOptions{closeAfterMessage: true},
+			wantMessages: 2,
+		},
+		{
+			// The session drops once the content of the second email is
+			// written, which may have been delivered and is not sent again.
+			name:         "dropped after the content",
+			opts:         smtpServerOptions{hangUpOnMessage: 2},
+			wantMessages: 2,
+			wantErr:      true,
+		},
+		{
+			name:         "dropped after the chunked content",
+			opts:         smtpServerOptions{extensions: []string{"CHUNKING"}, hangUpOnMessage: 2},
+			wantMessages: 2,
+			wantErr:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startSMTPServer(t, tt.opts)
+			p := newProviderTest(t, serverConfig(s, map[string]any{"reuse_connection": true, "use_chunking": true}))
+
+			mail := map[string]any{"to": []string{"alice@example.com"}, "subject": "Hello", "body": "Hello"}
+			p.create("smtp_send_mail", mail).mustApply(t)
+			err := diagnosticsError(p.create("smtp_send_mail", mail).diags)
+
+			if got := len(s.Messages()); got != tt.wantMessages {
+				t.Errorf("expected %d messages, got %d", tt.wantMessages, got)
+			}
+			if (err != "") != tt.wantErr {
+				t.Errorf("unexpected error %q", err)
+			}
+		})
+	}
+}
+
+func TestFailoverAfterContent(t *testing.T) {
+	tests := []struct {
+		name                string
+		primary             smtpServerOptions
+		continueOnRcptError bool
+		wantSecondary       int
+	}{
+		{
+			name:          "temporary failure before the content",
+			primary:       smtpServerOptions{rcptReplies: map[string]string{"alice@example.com": "451 4.3.0 try again later"}},
+			wantSecondary: 1,
+		},
+		{
+			name:    "permanent failure before the content",
+			primary: smtpServerOptions{rcptReplies: map[string]string{"alice@example.com": "550 5.1.1 unknown user"}},
+		},
+		{
+			name:                "every recipient rejected temporarily",
+			primary:             smtpServerOptions{rcptReplies: map[string]string{"alice@example.com": "451 4.3.0 try again later", "bob@example.com": "550 5.1.1 unknown user"}},
+			continueOnRcptError: true,
+			wantSecondary:       1,
+		},
+		{
+			name:                "every recipient rejected permanently",
+			primary:             smtpServerOptions{rcptReplies: map[string]string{"alice@example.com": "550 5.1.1 unknown user", "bob@example.com": "550 5.1.1 unknown user"}},
+			continueOnRcptError: true,
+		},
+		{
+			name:    "unanswered content",
+			primary: smtpServerOptions{hangUpOnMessage: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary := startSMTPServer(t, tt.primary)
+			secondary, err := net.Listen("tcp", "127.0.0.2:"+primary.port)
+			if err != nil {
+				t.Skipf("no second loopback address for the failover host: %v", err)
+			}
+			secondary.Close()
+			backup := startSMTPServerOn(t, "127.0.0.2:"+primary.port, smtpServerOptions{})
+
+			p := newProviderTest(t, serverConfig(primary, map[string]any{"hosts": []string{"127.0.0.2"}}))
+			p.create("smtp_send_mail", map[string]any{
+				"to":                     []string{"alice@example.com", "bob@example.com"},
+				"subject":                "Hello",
+				"body":                   "Hello",
+				"continue_on_rcpt_error": tt.continueOnRcptError,
+			})
+
+			if got := len(backup.Messages()); got != tt.wantSecondary {
+				t.Errorf("expected %d messages sent through the failover host, got %d", tt.wantSecondary, got)
+			}
+		})
+	}
+}
+
+func TestPlaintextServer(t *testing.T) {
+	tests := []struct {
+		name         string
+		config       map[string]any
+		wantUser     string
+		wantWarnings []string
+	}{
+		{name: "without authentication"},
+		{
+			name:         "with authentication",
+			config:       map[string]any{"authentication": true, "username": "user", "password": "secret"},
+			wantUser:     "user",
+			wantWarnings: []string{"SMTP Credentials Sent Unencrypted"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startSMTPServer(t, smtpServerOptions{users: map[string]string{"user": "secret"}})
+			p, diags := configureProviderTest(t, serverConfig(s, tt.config))
+			if err := diagnosticsError(diags); err != "" {
+				t.Fatalf("configuring the provider: %s", err)
+			}
+			if got := diagnosticSummaries(diags, tfprotov6.DiagnosticSeverityWarning); !reflect.DeepEqual(got, tt.wantWarnings) {
+				t.Errorf("expected the warnings %q, got %q", tt.wantWarnings, got)
+			}
+
+			p.create("smtp_send_mail", map[string]any{
+				"to":      []string{"alice@example.com"},
+				"subject": "Hello",
+				"body":    "Hello Alice",
+			}).mustApply(t)
+
+			messages := s.Messages()
+			if len(messages) != 1 {
+				t.Fatalf("expected one message, got %d", len(messages))
+			}
+			if messages[0].tls {
+				t.Errorf("expected the message to be sent in the clear")
+			}
+			if messages[0].user != tt.wantUser {
+				t.Errorf("expected the message to be sent as %q, got %q", tt.wantUser, messages[0].user)
+			}
+		})
+	}
+}
+
+func TestInternationalizedAddresses(t *testing.T) {
+	tests := []struct {
+		name       string
+		extensions []string
+		to         string
+		wantParams []string
+		wantRcpt   string
+		wantErr    string
+	}{
+		{
+			name:       "smtputf8",
+			extensions: []string{"SMTPUTF8"},
+			to:         "müller@例え.jp",
+			wantParams: []string{"SMTPUTF8"},
+			wantRcpt:   "müller@例え.jp",
+		},
+		{
+			name:     "punycode domain",
+			to:       "user@例え.jp",
+			wantRcpt: "user@xn--r8jz45g.jp",
+		},
+		{
+			name:    "non-ascii local part",
+			to:      "müller@例え.jp",
+			wantErr: "requires the SMTPUTF8 extension",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startSMTPServer(t, smtpServerOptions{extensions: tt.extensions})
+			p := newProviderTest(t, serverConfig(s, nil))
+			result := p.create("smtp_send_mail", map[string]any{
+				"to":      []string{tt.to},
+				"subject": "Hello",
+				"body":    "Hello",
+			})
+
+			messages := s.Messages()
+			if tt.wantErr != "" {
+				if err := diagnosticsError(result.diags); !strings.Contains(err, tt.wantErr) {
+					t.Errorf("expected an error containing %q, got %q", tt.wantErr, err)
+				}
+				if len(messages) != 0 {
+					t.Errorf("expected no message to be sent")
+				}
+				return
+			}
+			result.mustApply(t)
+			if len(messages) != 1 {
+				t.Fatalf("expected one message, got %d", len(messages))
+			}
+			if !slices.Equal(messages[0].params, tt.wantParams) {
+				t.Errorf("expected the MAIL parameters %q, got %q", tt.wantParams, messages[0].params)
+			}
+			if want := []string{tt.wantRcpt}; !reflect.DeepEqual(messages[0].to, want) {
+				t.Errorf("expected the recipients %q, got %q", want, messages[0].to)
+			}
+		})
+	}
+}
+
+func TestQuit(t *testing.T) {
+	tests := []struct {
+		name         string
+		opts         smtpServerOptions
+		wantWarnings []string
+	}{
+		{name: "accepted"},
+		{
+			name:         "unexpected reply",
+			opts:         smtpServerOptions{quitReply: "554 5.3.0 Something went wrong"},
+			wantWarnings: []string{"Error ending SMTP session"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startSMTPServer(t, tt.opts)
+			p := newProviderTest(t, serverConfig(s, nil))
+			result := p.create("smtp_send_mail", map[string]any{
+				"to":      []string{"alice@example.com"},
+				"subject": "Hello",
+				"body":    "Hello Alice",
+			}).mustApply(t)
+
+			if verbs := s.Verbs(); len(verbs) == 0 || verbs[len(verbs)-1] != "QUIT" {
+				t.Errorf("expected the session to end with QUIT, got %q", verbs)
+			}
+			if got := diagnosticSummaries(result.diags, tfprotov6.DiagnosticSeverityWarning); !reflect.DeepEqual(got, tt.wantWarnings) {
+				t.Errorf("expected the warnings %q, got %q", tt.wantWarnings, got)
+			}
+		})
+	}
+}
+
+func TestAuthOverImplicitTLS(t *testing.T) {
+	for _, mechanism := range []string{"login", "auto"} {
+		t.Run(mechanism, func(t *testing.T) {
+			s := startSMTPServer(t, smtpServerOptions{
+				implicitTLS: true,
+				users:       map[string]string{"user": "secret"},
+				mechanisms:  []string{"LOGIN"},
+				requireAuth: true,
+			})
+			p := newProviderTest(t, serverConfig(s, map[string]any{
+				"authentication": true,
+				"username":       "user",
+				"password":       "secret",
+				"auth_mechanism": mechanism,
+				"tls_mode":       "implicit",
+				"ca_cert_pem":    s.caPEM,
+			}))
+			p.create("smtp_send_mail", map[string]any{
+				"to":      []string{"alice@example.com"},
+				"subject": "Hello",
+				"body":    "Hello Alice",
+			}).mustApply(t)
+
+			// The session starts in TLS, so AUTH follows EHLO without STARTTLS.
+			commands := s.Commands()
+			if len(commands) < 2 || !strings.HasPrefix(commands[0], "EHLO ") || commands[1] != "AUTH LOGIN" {
+				t.Errorf("expected AUTH LOGIN right after EHLO, got %q", commands)
+			}
+			if slices.Contains(s.Verbs(), "STARTTLS") {
+				t.Errorf("expected no STARTTLS over implicit TLS, got %q", commands)
+			}
+			if m := s.Messages()[0]; !m.tls || m.user != "user" {
+				t.Errorf("expected the message to be sent over TLS as user, got tls %t as %q", m.tls, m.user)
+			}
+		})
+	}
+}
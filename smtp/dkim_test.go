@@ -0,0 +1,92 @@
+package smtp
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"testing"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+func TestDKIMSignatureVerifies(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating the RSA key: %v", err)
+	}
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generating the Ed25519 key: %v", err)
+	}
+	ed25519DER, err := x509.MarshalPKCS8PrivateKey(ed25519Key)
+	if err != nil {
+		t.Fatalf("encoding the Ed25519 key: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		keyPEM  []byte
+		keyType string
+		public  crypto.PublicKey
+	}{
+		{
+			name:    "rsa",
+			keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}),
+			keyType: "rsa",
+			public:  rsaKey.Public(),
+		},
+		{
+			name:    "ed25519",
+			keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: ed25519DER}),
+			keyType: "ed25519",
+			public:  ed25519Key.Public(),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var publicKey []byte
+			if tt.keyType == "ed25519" {
+				publicKey = tt.public.(ed25519.PublicKey)
+			} else if publicKey, err = x509.MarshalPKIXPublicKey(tt.public); err != nil {
+				t.Fatalf("encoding the public key: %v", err)
+			}
+			record := fmt.Sprintf("v=DKIM1; k=%s; p=%s", tt.keyType, base64.StdEncoding.EncodeToString(publicKey))
+
+			s := startSMTPServer(t, smtpServerOptions{})
+			p := newProviderTest(t, serverConfig(s, map[string]any{
+				"dkim_private_key_pem": string(tt.keyPEM),
+				"dkim_selector":        "mail",
+				"dkim_domain":          "example.com",
+			}))
+			p.create("smtp_send_mail", map[string]any{
+				"to":      []string{"alice@example.com"},
+				"subject": "Héllo",
+				"body":    "Hello Alice,\n\nThis email is signed.\n",
+			}).mustApply(t)
+
+			verifications, err := dkim.VerifyWithOptions(bytes.NewReader(s.Messages()[0].data), &dkim.VerifyOptions{
+				LookupTXT: func(domain string) ([]string, error) {
+					if domain != "mail._domainkey.example.com" {
+						return nil, fmt.Errorf("unexpected lookup of %s", domain)
+					}
+					return []string{record}, nil
+				},
+			})
+			if err != nil {
+				t.Fatalf("verifying the message: %v", err)
+			}
+			if len(verifications) != 1 {
+				t.Fatalf("expected one DKIM signature, got %d", len(verifications))
+			}
+			if v := verifications[0]; v.Err != nil || v.Domain != "example.com" {
+				t.Errorf("the DKIM signature of %s does not verify: %v", v.Domain, v.Err)
+			}
+		})
+	}
+}
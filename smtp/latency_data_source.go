@@ -0,0 +1,115 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-framework/datasource"
+	"github.com/hashicorp/terraform-plugin-framework/datasource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+)
+
+// Ensure the implementation satisfies the expected interfaces.
+var (
+	_ datasource.DataSource              = &latencyDataSource{}
+	_ datasource.DataSourceWithConfigure = &latencyDataSource{}
+)
+
+// NewLatencyDataSource is a helper function to simplify the provider implementation.
+func NewLatencyDataSource() datasource.DataSource {
+	return &latencyDataSource{}
+}
+
+// latencyDataSource is the data source implementation.
+type latencyDataSource struct {
+	client *client
+}
+
+type latencyDataSourceModel struct {
+	Host           types.String  `tfsdk:"host"`
+	ConnectMs      types.Float64 `tfsdk:"connect_ms"`
+	TLSHandshakeMs types.Float64 `tfsdk:"tls_handshake_ms"`
+	TotalMs        types.Float64 `tfsdk:"total_ms"`
+}
+
+// Configure adds the provider configured client to the data source.
+func (d *latencyDataSource) Configure(_ context.Context, req datasource.ConfigureRequest, _ *datasource.ConfigureResponse) {
+	if req.ProviderData == nil {
+		return
+	}
+
+	d.client = req.ProviderData.(*client)
+}
+
+// Metadata returns the data source type name.
+func (d *latencyDataSource) Metadata(_ context.Context, req datasource.MetadataRequest, resp *datasource.MetadataResponse) {
+	resp.TypeName = req.ProviderTypeName + "_latency"
+}
+
+// Schema defines the schema for the data source.
+func (d *latencyDataSource) Schema(_ context.Context, _ datasource.SchemaRequest, resp *datasource.SchemaResponse) {
+	resp.Schema = schema.Schema{
+		Description: "Measure the round trip latency of a session with the SMTP host, from the connection to the reply to `QUIT`, eg. to track the relay latency over time. The session is set up as for sending an email, with the provider proxy and TLS settings, but without authenticating, and fails as a send would when the `starttls` mode cannot upgrade it to TLS. The session is bounded by the provider `timeout`, or by 30 seconds if not set. Note: The SMTP host is connected to every time the data source is read.",
+		Attributes: map[string]schema.Attribute{
+			"host": schema.StringAttribute{
+				Optional:    true,
+				Computed:    true,
+				Description: "SMTP host to measure, reached on the provider port. If not provided, the first of the provider `host` and `hosts` is used.",
+			},
+			"connect_ms": schema.Float64Attribute{
+				Description: "Time taken to open the connection with the SMTP host, in milliseconds.",
+				Computed:    true,
+			},
+			"tls_handshake_ms": schema.Float64Attribute{
+				Description: "Time taken by the TLS handshake, including the `STARTTLS` command with the `starttls` mode, in milliseconds. Zero when the session is not encrypted.",
+				Computed:    true,
+			},
+			"total_ms": schema.Float64Attribute{
+				Description: "Time taken by the whole session, from the connection to the reply to `QUIT`, in milliseconds.",
+				Computed:    true,
+			},
+		},
+	}
+}
+
+// Read connects to the SMTP host and records the latency of the session.
+func (d *latencyDataSource) Read(ctx context.Context, req datasource.ReadRequest, resp *datasource.ReadResponse) {
+	var config latencyDataSourceModel
+	diags := req.Config.Get(ctx, &config)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	host := config.Host.ValueString()
+	if host == "" {
+		host = d.client.hosts[0]
+	}
+
+	l, err := d.client.probe(host)
+	if err != nil {
+		var sendErr *sendError
+		if errors.As(err, &sendErr) {
+			resp.Diagnostics.AddError(sendErr.diagnostic())
+		} else {
+			resp.Diagnostics.AddError("Error measuring SMTP latency:", err.Error())
+		}
+		return
+	}
+	tflog.Debug(ctx, "Measured SMTP latency", map[string]any{"smtp_host": host, "total_ms": milliseconds(l.total)})
+
+	config.Host = types.StringValue(host)
+	config.ConnectMs = types.Float64Value(milliseconds(l.connect))
+	config.TLSHandshakeMs = types.Float64Value(milliseconds(l.tlsHandshake))
+	config.TotalMs = types.Float64Value(milliseconds(l.total))
+
+	diags = resp.State.Set(ctx, config)
+	resp.Diagnostics.Append(diags...)
+}
+
+// milliseconds returns the duration in fractional milliseconds.
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,128 @@
+package smtp
+
+import (
+	"math/big"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLatency(t *testing.T) {
+	tests := []struct {
+		name          string
+		tlsMode       string
+		wantHandshake bool
+	}{
+		{name: "unencrypted", tlsMode: "none"},
+		{name: "starttls", tlsMode: "starttls", wantHandshake: true},
+		{name: "implicit", tlsMode: "implicit", wantHandshake: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startSMTPServer(t, smtpServerOptions{
+				starttls:    tt.tlsMode == "starttls",
+				implicitTLS: tt.tlsMode == "implicit",
+			})
+			p := newProviderTest(t, serverConfig(s, map[string]any{"tls_mode": tt.tlsMode, "ca_cert_pem": s.caPEM}))
+			state, diags := p.read("smtp_latency", map[string]any{})
+			if err := diagnosticsError(diags); err != "" {
+				t.Fatalf("reading the latency: %s", err)
+			}
+
+			if got := stateString(t, state, "host"); got != s.host {
+				t.Errorf("expected the provider host %s, got %s", s.host, got)
+			}
+			var total, handshake *big.Float
+			if err := stateAttr(t, state, "total_ms").As(&total); err != nil || total.Sign() <= 0 {
+				t.Errorf("expected the session to be timed, got %v: %v", total, err)
+			}
+			if err := stateAttr(t, state, "tls_handshake_ms").As(&handshake); err != nil || (handshake.Sign() > 0) != tt.wantHandshake {
+				t.Errorf("expected the TLS handshake to be timed only over TLS, got %v: %v", handshake, err)
+			}
+			if verbs := s.Verbs(); slices.Contains(verbs, "AUTH") || !slices.Contains(verbs, "QUIT") {
+				t.Errorf("expected the session to end with QUIT without authenticating, got %q", verbs)
+			}
+		})
+	}
+}
+
+func TestLatencyStartTLS(t *testing.T) {
+	tests := []struct {
+		name     string
+		starttls bool
+		wantErr  string
+	}{
+		{name: "offered", starttls: true},
+		{name: "not offered", wantErr: "the SMTP server does not offer STARTTLS"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startSMTPServer(t, smtpServerOptions{starttls: tt.starttls, users: map[string]string{"user": "secret"}})
+			p := newProviderTest(t, serverConfig(s, map[string]any{
+				"authentication": true,
+				"username":       "user",
+				"password":       "secret",
+				"tls_mode":       "starttls",
+				"ca_cert_pem":    s.caPEM,
+			}))
+			state, diags := p.read("smtp_latency", map[string]any{})
+
+			err := diagnosticsError(diags)
+			if tt.wantErr != "" {
+				if !strings.Contains(err, tt.wantErr) {
+					t.Errorf("expected an error containing %q, got %q", tt.wantErr, err)
+				}
+				return
+			}
+			if err != "" {
+				t.Fatalf("reading the latency: %s", err)
+			}
+			var handshake *big.Float
+			if err := stateAttr(t, state, "tls_handshake_ms").As(&handshake); err != nil || handshake.Sign() <= 0 {
+				t.Errorf("expected the STARTTLS handshake to be timed, got %v: %v", handshake, err)
+			}
+		})
+	}
+}
+
+func TestLatencyDeadline(t *testing.T) {
+	// The server accepts the connection but never sends its greeting.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	for _, tlsMode := range []string{"none", "implicit"} {
+		t.Run(tlsMode, func(t *testing.T) {
+			p := newProviderTest(t, map[string]any{
+				"host":           host,
+				"port":           port,
+				"authentication": false,
+				"tls_mode":       tlsMode,
+				"timeout":        "200ms",
+			})
+
+			start := time.Now()
+			_, diags := p.read("smtp_latency", map[string]any{})
+			if diagnosticsError(diags) == "" {
+				t.Errorf("expected the unresponsive server to fail the read")
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("expected the read to fail within the timeout, took %s", elapsed)
+			}
+		})
+	}
+}
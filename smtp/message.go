@@ -0,0 +1,686 @@
+package smtp
+
+import (
+	"bufio"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// message holds the parts of an email assembled from the resource plan.
+type message struct {
+	messageID   string
+	from        []string
+	sender      string
+	replyTo     []string
+	returnPath  string
+	to, cc, bcc []string
+	subject     string
+	html        bool
+	body        string
+	// charset is the charset the body is transcoded to, UTF-8 when empty.
+	// autoCharset sends the body as UTF-8 instead, without a charset when it
+	// is ASCII.
+	charset     string
+	autoCharset bool
+	// wrapText soft-wraps long lines of plain text bodies.
+	wrapText bool
+	// listUnsubscribe holds the List-Unsubscribe URLs; oneClick advertises
+	// RFC 8058 one-click unsubscription through them.
+	listUnsubscribe []string
+	oneClick        bool
+	// inReplyTo and references thread the message under earlier ones.
+	inReplyTo  string
+	references []string
+	// inlineImages are embedded in the HTML body, which is then sent in a
+	// multipart/related structure.
+	inlineImages []inlineImage
+	// bodyAttachment is the filename the body is attached as, with bodyNote
+	// sent inline instead. The body is not attached when empty.
+	bodyAttachment string
+	bodyNote       string
+	// calendar is the meeting request sent along with the body in a
+	// multipart/alternative structure.
+	calendar *calendarInvite
+	// contentType overrides the text/plain or text/html content type of the
+	// body when set, eg. text/calendar.
+	contentType string
+	// headerEncoding is the RFC 2047 encoding of the non-ASCII subject and
+	// display names: auto, base64 or quoted-printable.
+	headerEncoding string
+	// boundarySeed derives the multipart boundaries when set, instead of
+	// random ones.
+	boundarySeed string
+	// sevenBit quoted-printable encodes the 8-bit bodies, for the servers that
+	// do not advertise 8BITMIME.
+	sevenBit bool
+	// raw sends the body verbatim as the MIME entity of the message, its own
+	// content headers included.
+	raw bool
+	// autoSubmitted is the RFC 3834 Auto-Submitted header, left out when no.
+	autoSubmitted string
+	// precedence is the non-standard Precedence header, eg. bulk.
+	precedence string
+	// attachments are attached to the body in a multipart/mixed structure.
+	attachments []attachment
+	// smime signs and encrypts the MIME entity of the message when set.
+	smime *smime
+}
+
+const (
+	// wrapLineLength is the column plain text bodies are wrapped at.
+	wrapLineLength = 76
+	// maxLineLength is the RFC 5321 line length limit, excluding CRLF.
+	maxLineLength = 998
+)
+
+// header returns the header section of the message. BCC addresses are
+// intentionally never written to the headers.
+func (m *message) header() string {
+	var header strings.Builder
+	if m.returnPath != "" {
+		writeHeader(&header, "Return-Path", "<"+normalizeReturnPath(m.returnPath)+">")
+	}
+	if m.messageID != "" {
+		writeHeader(&header, "Message-ID", m.messageID)
+	}
+	if m.inReplyTo != "" {
+		writeHeader(&header, "In-Reply-To", m.inReplyTo)
+	}
+	if len(m.references) > 0 {
+		writeHeader(&header, "References", strings.Join(m.references, " "))
+	}
+	if len(m.from) > 0 {
+		writeHeader(&header, "From", m.encodeAddresses(m.from))
+	}
+	if m.sender != "" {
+		writeHeader(&header, "Sender", m.encodeAddress(m.sender))
+	}
+	if len(m.replyTo) > 0 {
+		writeHeader(&header, "Reply-To", m.encodeAddresses(m.replyTo))
+	}
+	// Empty address headers are left out rather than sent blank.
+	if len(m.to) > 0 {
+		writeHeader(&header, "To", m.encodeAddresses(m.to))
+	}
+	if len(m.cc) > 0 {
+		writeHeader(&header, "Cc", m.encodeAddresses(m.cc))
+	}
+	writeHeader(&header, "Subject", m.encodeWord(m.subject))
+	if len(m.listUnsubscribe) > 0 {
+		writeHeader(&header, "List-Unsubscribe", "<"+strings.Join(m.listUnsubscribe, ">, <")+">")
+		if m.oneClick {
+			writeHeader(&header, "List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
+		}
+	}
+	if m.autoSubmitted != "" && m.autoSubmitted != "no" {
+		writeHeader(&header, "Auto-Submitted", m.autoSubmitted)
+	}
+	if m.precedence != "" {
+		writeHeader(&header, "Precedence", m.precedence)
+	}
+	return header.String()
+}
+
+// parseListUnsubscribe splits a comma separated list of mailto: and http(s):
+// URLs, optionally enclosed in angle brackets, into the bare URLs.
+func parseListUnsubscribe(value string) ([]string, error) {
+	var urls []string
+	for _, raw := range strings.Split(value, ",") {
+		raw = strings.TrimSpace(raw)
+		raw = strings.TrimSuffix(strings.TrimPrefix(raw, "<"), ">")
+		if raw == "" {
+			continue
+		}
+
+		u, err := url.Parse(raw)
+		if err != nil {
+			return nil, err
+		}
+		switch u.Scheme {
+		case "mailto":
+			if u.Opaque == "" {
+				return nil, fmt.Errorf("mailto URL %q has no address", raw)
+			}
+		case "http", "https":
+			if u.Host == "" {
+				return nil, fmt.Errorf("URL %q has no host", raw)
+			}
+		default:
+			return nil, fmt.Errorf("URL %q must use the mailto, http or https scheme", raw)
+		}
+		if strings.ContainsAny(raw, " <>\r\n") {
+			return nil, fmt.Errorf("URL %q contains invalid characters", raw)
+		}
+		urls = append(urls, raw)
+	}
+	if len(urls) == 0 {
+		return nil, errors.New("at least one URL is required")
+	}
+	return urls, nil
+}
+
+// hasHTTPS reports whether one of the URLs supports RFC 8058 one-click
+// unsubscription, which requires an https URL.
+func hasHTTPS(urls []string) bool {
+	for _, u := range urls {
+		if strings.HasPrefix(u, "https:") {
+			return true
+		}
+	}
+	return false
+}
+
+// newMessageID generates a unique Message-ID on the domain of the sender
+// address, or of the SMTP host when the sender has no domain.
+func newMessageID(from, host string) string {
+	domain := host
+	if at := strings.LastIndex(from, "@"); at >= 0 && at < len(from)-1 {
+		domain = strings.TrimSuffix(from[at+1:], ">")
+	}
+
+	random := make([]byte, 16)
+	rand.Read(random)
+	return fmt.Sprintf("<%x.%d@%s>", random, time.Now().Unix(), domain)
+}
+
+// suffixMessageID appends the revision to the left part of the Message-ID.
+func suffixMessageID(id string, revision int) string {
+	at := strings.LastIndex(id, "@")
+	return id[:at] + "." + strconv.Itoa(revision) + id[at:]
+}
+
+// messageIDRevision returns the revision the Message-ID was suffixed with by
+// suffixMessageID from the base one, 0 when it is the base one, or -1 when it
+// is not derived from it.
+func messageIDRevision(id, base string) int {
+	if id == base {
+		return 0
+	}
+	at, baseAt := strings.LastIndex(id, "@"), strings.LastIndex(base, "@")
+	if at < 0 || baseAt < 0 || id[at:] != base[baseAt:] || !strings.HasPrefix(id[:at], base[:baseAt]+".") {
+		return -1
+	}
+	revision, err := strconv.Atoi(id[baseAt+1 : at])
+	if err != nil || revision < 1 {
+		return -1
+	}
+	return revision
+}
+
+// normalizeMessageID wraps the Message-ID in angle brackets when missing,
+// checking that it has the <left@right> form.
+func normalizeMessageID(id string) (string, error) {
+	id = strings.TrimSpace(id)
+	bare := strings.TrimSuffix(strings.TrimPrefix(id, "<"), ">")
+	left, right, ok := strings.Cut(bare, "@")
+	if !ok || left == "" || right == "" || strings.ContainsAny(bare, "<> \t\r\n") || strings.Contains(right, "@") {
+		return "", fmt.Errorf("%q is not a valid Message-ID, expected the <id@domain> form", id)
+	}
+	return "<" + bare + ">", nil
+}
+
+// normalizeReturnPath returns the bare address of the Return-Path.
+func normalizeReturnPath(addr string) string {
+	if bare, err := bareAddress(addr); err == nil {
+		return bare
+	}
+	return addr
+}
+
+// encodeWord encodes the non-ASCII text as RFC 2047 encoded-words, with the
+// configured encoding or, with auto, the shortest one. ASCII text is returned
+// unchanged.
+func (m *message) encodeWord(text string) string {
+	b := mime.BEncoding.Encode("UTF-8", text)
+	q := mime.QEncoding.Encode("UTF-8", text)
+	switch m.headerEncoding {
+	case "base64":
+		return b
+	case "quoted-printable":
+		return q
+	}
+	if len(q) <= len(b) {
+		return q
+	}
+	return b
+}
+
+// encodeAddress encodes the non-ASCII display name of the address. Addresses
+// that cannot be parsed are returned unchanged.
+func (m *message) encodeAddress(addr string) string {
+	parsed, err := mail.ParseAddress(addr)
+	if err != nil || parsed.Name == "" || isASCII(parsed.Name) {
+		return addr
+	}
+	return m.encodeWord(parsed.Name) + " <" + parsed.Address + ">"
+}
+
+// encodeAddresses encodes the display names of the addresses, joined for an
+// address list header.
+func (m *message) encodeAddresses(addrs []string) string {
+	encoded := make([]string, len(addrs))
+	for i, addr := range addrs {
+		encoded[i] = m.encodeAddress(addr)
+	}
+	return strings.Join(encoded, ", ")
+}
+
+// foldLineLength is the RFC 5322 recommended header line length, excluding
+// CRLF.
+const foldLineLength = 78
+
+// listHeaders are the header fields holding comma separated lists, which are
+// only folded between their elements.
+var listHeaders = map[string]bool{
+	"From":             true,
+	"Reply-To":         true,
+	"To":               true,
+	"Cc":               true,
+	"List-Unsubscribe": true,
+}
+
+// writeHeader writes a single header field, folded as per RFC 5322 when longer
+// than foldLineLength: the continuation lines start with the whitespace the
+// field is broken before, so that unfolding restores the value. List fields
+// are broken after the commas between their elements, the others before any
+// whitespace. A value without a break point is written as is.
+func writeHeader(header *strings.Builder, name, value string) {
+	field := name + ": " + value
+	line := 0
+	start := len(name) + 2
+	for len(field)-line > foldLineLength {
+		cut := -1
+		for i := start; i < len(field) && (cut < 0 || i-line <= foldLineLength); i++ {
+			if field[i] != ' ' && field[i] != '\t' {
+				continue
+			}
+			if listHeaders[name] && field[i-1] != ',' {
+				continue
+			}
+			// Continuation lines must not be whitespace only.
+			if strings.TrimSpace(field[line:i]) == "" || strings.TrimSpace(field[i:]) == "" {
+				continue
+			}
+			cut = i
+		}
+		if cut < 0 {
+			break
+		}
+		header.WriteString(field[line:cut] + "\r\n")
+		line, start = cut, cut+1
+	}
+	header.WriteString(field[line:] + "\r\n")
+}
+
+// content returns the body to send along with its content headers. Plain text
+// bodies are wrapped when enabled, falling back to quoted-printable when a line
+// cannot be wrapped. HTML and other bodies are left untouched. The body is
+// transcoded to the message charset, and quoted-printable encoded when it has
+// 8-bit content in 7-bit mode.
+func (m *message) content() (string, string, error) {
+	charset, enc, err := m.lookupCharset()
+	if err != nil {
+		return "", "", err
+	}
+	contentType := "MIME-Version: 1.0\r\n" +
+		"Content-Type: " + m.mediaType(charset) + "\r\n"
+	plain := m.plain()
+
+	body, wrapped := m.body, true
+	if plain && m.wrapText {
+		if text, ok := wrapText(body); ok {
+			body = text
+		} else {
+			wrapped = false
+		}
+	}
+	if body, err = enc.NewEncoder().String(body); err != nil {
+		return "", "", fmt.Errorf("the body cannot be encoded in the %s charset: %w", charset, err)
+	}
+
+	switch {
+	case !wrapped || m.sevenBit && !isASCII(body):
+		var encoded strings.Builder
+		w := quotedprintable.NewWriter(&encoded)
+		w.Write([]byte(body))
+		w.Close()
+		return encoded.String(), contentType +
+			"Content-Transfer-Encoding: quoted-printable\r\n", nil
+	case !plain || m.contentType != "" || charset != "" && (charset != "UTF-8" || !isASCII(body)):
+		// Only a pure ASCII plain text body goes without a Content-Type, as
+		// the readers assume US-ASCII for it.
+		return body, contentType, nil
+	}
+	return body, "", nil
+}
+
+// plain reports whether the body is plain text, which is wrapped.
+func (m *message) plain() bool {
+	if m.html {
+		return false
+	}
+	if m.contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(m.contentType)
+	return err == nil && mediaType == "text/plain"
+}
+
+// mediaType returns the content type of the body along with its charset,
+// unless the configured content type already has one or the charset is empty.
+func (m *message) mediaType(charset string) string {
+	contentType := "text/plain"
+	switch {
+	case m.contentType != "":
+		contentType = m.contentType
+	case m.html:
+		contentType = "text/html"
+	}
+
+	if charset == "" {
+		return contentType
+	}
+	if _, params, err := mime.ParseMediaType(contentType); err == nil && params["charset"] != "" {
+		return contentType
+	}
+	return contentType + "; charset=\"" + charset + "\""
+}
+
+// attachBody returns the multipart/mixed body with the note sent inline and
+// the body attached as a file, along with its content headers.
+func (m *message) attachBody() (string, string, error) {
+	charset, enc, err := m.lookupCharset()
+	if err != nil {
+		return "", "", err
+	}
+	data, err := enc.NewEncoder().String(m.body)
+	if err != nil {
+		return "", "", fmt.Errorf("the body cannot be encoded in the %s charset: %w", charset, err)
+	}
+	attachmentType := m.mediaType(charset)
+
+	note := *m
+	note.body, note.html, note.inlineImages, note.contentType = m.bodyNote, false, nil, ""
+	noteBody, noteHeader, err := note.content()
+	if err != nil {
+		return "", "", err
+	}
+	return mixed(m.boundarySeed, noteBody, noteHeader, append([]attachment{{
+		filename:    m.bodyAttachment,
+		contentType: attachmentType,
+		data:        []byte(data),
+	}}, m.attachments...))
+}
+
+// lookupCharset resolves the charset of the body. With autoCharset, the body
+// is sent as UTF-8, and the charset is empty when the body is ASCII.
+func (m *message) lookupCharset() (string, encoding.Encoding, error) {
+	if !m.autoCharset {
+		return lookupCharset(m.charset)
+	}
+	if isASCII(m.body) {
+		return "", unicode.UTF8, nil
+	}
+	return "UTF-8", unicode.UTF8, nil
+}
+
+// lookupCharset resolves the charset name to its canonical MIME name and
+// encoding, defaulting to UTF-8.
+func lookupCharset(name string) (string, encoding.Encoding, error) {
+	if name == "" || strings.EqualFold(name, "UTF-8") {
+		return "UTF-8", unicode.UTF8, nil
+	}
+
+	enc, err := ianaindex.MIME.Encoding(name)
+	if err != nil || enc == nil {
+		return "", nil, fmt.Errorf("unknown charset %q", name)
+	}
+	canonical, err := ianaindex.MIME.Name(enc)
+	if err != nil || canonical == "" {
+		canonical = name
+	}
+	return canonical, enc, nil
+}
+
+// bytes assembles the message to write to the DATA command.
+func (m *message) bytes() ([]byte, error) {
+	var body, contentHeader string
+	var err error
+	switch {
+	case m.raw:
+		body, contentHeader, err = splitRawBody(m.body)
+	case m.bodyAttachment != "":
+		body, contentHeader, err = m.attachBody()
+	default:
+		body, contentHeader, err = m.content()
+		if err == nil && len(m.inlineImages) > 0 {
+			body, contentHeader, err = related(m.boundarySeed, body, contentHeader, m.inlineImages)
+		}
+		if err == nil && m.calendar != nil {
+			body, contentHeader, err = alternative(m.boundarySeed, body, contentHeader, m.calendar)
+		}
+		if err == nil && len(m.attachments) > 0 {
+			body, contentHeader, err = mixed(m.boundarySeed, body, contentHeader, m.attachments)
+		}
+	}
+	if err == nil && m.smime != nil {
+		body, contentHeader, err = m.smime.wrap(m.boundarySeed, body, contentHeader)
+	}
+	if err != nil {
+		return nil, err
+	}
+	header := m.header() + contentHeader
+	if err := m.checkBccHidden(header); err != nil {
+		return nil, err
+	}
+
+	return []byte(normalizeNewlines(header +
+		"\r\n" +
+		body + "\r\n")), nil
+}
+
+// splitRawBody splits the raw body into its content and its MIME headers,
+// which must at least hold a Content-Type.
+func splitRawBody(raw string) (string, string, error) {
+	header, body, ok := strings.Cut(normalizeNewlines(raw), "\r\n\r\n")
+	if !ok {
+		return "", "", errors.New("the raw body must start with its MIME headers followed by an empty line")
+	}
+	fields, err := textproto.NewReader(bufio.NewReader(strings.NewReader(header + "\r\n\r\n"))).ReadMIMEHeader()
+	if err != nil {
+		return "", "", fmt.Errorf("the raw body headers are malformed: %w", err)
+	}
+	if fields.Get("Content-Type") == "" {
+		return "", "", errors.New("the raw body headers must include Content-Type")
+	}
+	return body, header + "\r\n", nil
+}
+
+// normalizeNewlines converts the bare LF line endings, eg. of heredoc bodies,
+// to the CRLF line endings required by SMTP, leaving the CRLF ones untouched.
+func normalizeNewlines(text string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(text, "\r\n", "\n"), "\n", "\r\n")
+}
+
+// visibleAddressHeaders are the header fields whose addresses are shown to the
+// recipients.
+var visibleAddressHeaders = []string{"From", "Sender", "Reply-To", "To", "Cc"}
+
+// checkBccHidden guards against BCC addresses leaking into the header section.
+// The address lists of the visible address headers are parsed and compared to
+// the BCC addresses as whole normalized addresses, so an address merely
+// containing a BCC one, or a subject mentioning it, is not mistaken for a
+// leak. Addresses that are also listed in From, Sender, Return-Path, To or Cc
+// are expected to be visible.
+func (m *message) checkBccHidden(header string) error {
+	visible := map[string]bool{}
+	for _, addr := range append(append(append([]string{m.sender, m.returnPath}, m.from...), m.to...), m.cc...) {
+		visible[normalizeAddress(addr)] = true
+	}
+
+	parsed, err := mail.ReadMessage(strings.NewReader(header + "\r\n"))
+	if err != nil {
+		return fmt.Errorf("the email headers are malformed: %w", err)
+	}
+	listed := map[string]bool{}
+	for _, name := range visibleAddressHeaders {
+		if parsed.Header.Get(name) == "" {
+			continue
+		}
+		addrs, err := parsed.Header.AddressList(name)
+		if err != nil {
+			return fmt.Errorf("the %s header is malformed: %w", name, err)
+		}
+		for _, addr := range addrs {
+			listed[strings.ToLower(addr.Address)] = true
+		}
+	}
+
+	for _, addr := range m.bcc {
+		addr = normalizeAddress(addr)
+		if addr != "" && !visible[addr] && listed[addr] {
+			return fmt.Errorf("bcc address %s would be visible in the email headers", addr)
+		}
+	}
+	return nil
+}
+
+// envelopeRecipients returns the bare addresses used for the RCPT commands,
+// including the BCC addresses. Addresses are deduplicated case-insensitively
+// across To, Cc and Bcc, so each recipient is only sent the email once.
+func (m *message) envelopeRecipients() ([]string, error) {
+	occurred := map[string]bool{}
+	result := []string{}
+	for _, addr := range append(append(append([]string{}, m.to...), m.cc...), m.bcc...) {
+		bare, err := bareAddress(addr)
+		if err != nil {
+			return nil, err
+		}
+		if key := strings.ToLower(bare); !occurred[key] {
+			occurred[key] = true
+			result = append(result, bare)
+		}
+	}
+	return result, nil
+}
+
+// bareAddress returns the address without its display name, eg.
+// user@example.com for "User <user@example.com>".
+func bareAddress(addr string) (string, error) {
+	parsed, err := mail.ParseAddress(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid email address %q: %w", addr, err)
+	}
+	return parsed.Address, nil
+}
+
+// isPlusAddress reports whether the address uses plus addressing, that is
+// has a +tag in its local part, eg. user+tag@example.com.
+func isPlusAddress(addr string) bool {
+	bare, err := bareAddress(addr)
+	if err != nil {
+		return false
+	}
+	at := strings.LastIndex(bare, "@")
+	return at > 0 && strings.Contains(bare[:at], "+")
+}
+
+// maskAddress partially redacts the address, keeping the first character of
+// its local part and its domain, eg. u***@example.com for user@example.com.
+func maskAddress(addr string) string {
+	at := strings.LastIndex(addr, "@")
+	if at <= 0 {
+		return "***"
+	}
+	_, size := utf8.DecodeRuneInString(addr)
+	return addr[:size] + "***" + addr[at:]
+}
+
+// recipientMasker replaces the recipient addresses with their masked form,
+// eg. in the server replies or the assembled email.
+func recipientMasker(recipients []string) *strings.Replacer {
+	var pairs []string
+	for _, addr := range recipients {
+		pairs = append(pairs, addr, maskAddress(addr))
+	}
+	return strings.NewReplacer(pairs...)
+}
+
+// withDisplayName returns the address with the display name, replacing the one
+// it has, eg. "Alerts Bot" <alerts@example.com>. It also returns the replaced
+// display name. Non-ASCII names are RFC 2047 encoded when writing the header.
+func withDisplayName(addr, name string) (string, string, error) {
+	parsed, err := mail.ParseAddress(addr)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid email address %q: %w", addr, err)
+	}
+	replaced := parsed.Name
+	parsed.Name = name
+	return parsed.String(), replaced, nil
+}
+
+// qualifyAddress appends the domain to the address given as a bare local part,
+// eg. alerts or Alerts <alerts>.
+func qualifyAddress(addr, domain string) string {
+	addr = strings.TrimSpace(addr)
+	if strings.HasSuffix(addr, ">") {
+		return strings.TrimSuffix(addr, ">") + "@" + domain + ">"
+	}
+	return addr + "@" + domain
+}
+
+// normalizeAddress returns the lowercase bare address, or the lowercase input
+// when it cannot be parsed.
+func normalizeAddress(addr string) string {
+	if bare, err := bareAddress(addr); err == nil {
+		return strings.ToLower(bare)
+	}
+	return strings.ToLower(strings.TrimSpace(addr))
+}
+
+// wrapText soft-wraps the lines longer than wrapLineLength on whitespace. It
+// reports false when a line cannot be wrapped within maxLineLength.
+func wrapText(text string) (string, bool) {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		line = strings.TrimSuffix(line, "\r")
+		if len(line) <= wrapLineLength {
+			continue
+		}
+
+		var wrapped []string
+		current := ""
+		for _, word := range strings.Split(line, " ") {
+			if len(word) > maxLineLength {
+				return "", false
+			}
+			if current != "" && len(current)+1+len(word) > wrapLineLength {
+				wrapped = append(wrapped, current)
+				current = word
+				continue
+			}
+			if current == "" {
+				current = word
+			} else {
+				current += " " + word
+			}
+		}
+		wrapped = append(wrapped, current)
+		lines[i] = strings.Join(wrapped, "\r\n")
+	}
+	return strings.Join(lines, "\n"), true
+}
@@ -0,0 +1,231 @@
+package smtp
+
+import (
+	"mime"
+	"strings"
+	"testing"
+)
+
+func TestBoundarySeed(t *testing.T) {
+	boundary := func(t *testing.T, seed string) string {
+		t.Helper()
+		m := message{
+			from:           []string{"sender@example.com"},
+			to:             []string{"alice@example.com"},
+			subject:        "Report",
+			body:           "a,b\n1,2\n",
+			bodyAttachment: "report.csv",
+			boundarySeed:   seed,
+		}
+		data, err := m.bytes()
+		if err != nil {
+			t.Fatalf("assembling the message: %v", err)
+		}
+		mediaType, params, err := mime.ParseMediaType(readHeader(t, data).Get("Content-Type"))
+		if err != nil || mediaType != "multipart/mixed" {
+			t.Fatalf("expected a multipart/mixed message, got %q: %v", mediaType, err)
+		}
+		return params["boundary"]
+	}
+
+	if got, want := boundary(t, "seed"), seededBoundary("seed", "mixed"); got != want {
+		t.Errorf("expected the seeded boundary %q, got %q", want, got)
+	}
+	if boundary(t, "seed") == boundary(t, "other seed") {
+		t.Errorf("expected the boundaries of different seeds to differ")
+	}
+	if boundary(t, "") == boundary(t, "") {
+		t.Errorf("expected random boundaries without a seed")
+	}
+}
+
+func TestNoEmptyHeaderLines(t *testing.T) {
+	tests := []struct {
+		name     string
+		message  message
+		wantNone []string
+	}{
+		{
+			name:     "without cc",
+			message:  message{from: []string{"sender@example.com"}, to: []string{"alice@example.com"}, cc: []string{}, subject: "Hello"},
+			wantNone: []string{"Cc"},
+		},
+		{
+			name:     "bcc only",
+			message:  message{from: []string{"sender@example.com"}, bcc: []string{"bob@example.com"}, subject: "Hello"},
+			wantNone: []string{"To", "Cc", "Bcc"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.message.body = "Hello"
+			data, err := tt.message.bytes()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			for _, line := range headerLines(data) {
+				name, value, ok := strings.Cut(line, ":")
+				if !ok && !strings.HasPrefix(line, " ") || ok && strings.TrimSpace(value) == "" {
+					t.Errorf("empty header line %q", line)
+				}
+				for _, absent := range tt.wantNone {
+					if strings.EqualFold(name, absent) {
+						t.Errorf("unexpected %s header line %q", absent, line)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRawBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		wantType string
+		wantErr  string
+	}{
+		{
+			name:     "mime entity",
+			body:     "Content-Type: multipart/signed; protocol=\"application/pgp-signature\"; boundary=\"b\"\n\n--b\nContent-Type: text/plain\n\nHello\n--b--\n",
+			wantType: `multipart/signed; protocol="application/pgp-signature"; boundary="b"`,
+		},
+		{name: "no headers", body: "Hello", wantErr: "the raw body must start with its MIME headers followed by an empty line"},
+		{name: "no content type", body: "X-Note: hi\n\nHello", wantErr: "the raw body headers must include Content-Type"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := message{
+				from:    []string{"sender@example.com"},
+				to:      []string{"alice@example.com"},
+				subject: "Hello",
+				body:    tt.body,
+				raw:     true,
+			}
+			data, err := m.bytes()
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("expected error %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("assembling the message: %v", err)
+			}
+			if got := readHeader(t, data).Get("Content-Type"); got != tt.wantType {
+				t.Errorf("expected the raw Content-Type %q, got %q", tt.wantType, got)
+			}
+			if !strings.Contains(string(data), "\r\n\r\n--b\r\nContent-Type: text/plain\r\n\r\nHello\r\n--b--\r\n") {
+				t.Errorf("expected the raw body to be sent verbatim, got %q", data)
+			}
+		})
+	}
+}
+
+func TestCheckBccHidden(t *testing.T) {
+	tests := []struct {
+		name    string
+		message message
+		wantErr string
+	}{
+		{
+			name:    "bcc suffix of a to address",
+			message: message{from: []string{"sender@example.com"}, to: []string{"jimbob@example.com"}, bcc: []string{"bob@example.com"}},
+		},
+		{
+			name:    "bcc mentioned in the subject",
+			message: message{from: []string{"sender@example.com"}, to: []string{"alice@example.com"}, bcc: []string{"bob@example.com"}, subject: "Copy for bob@example.com"},
+		},
+		{
+			name:    "bcc also in to",
+			message: message{from: []string{"sender@example.com"}, to: []string{"Bob <BOB@example.com>"}, bcc: []string{"bob@example.com"}},
+		},
+		{
+			name:    "bcc display name in cc",
+			message: message{from: []string{"sender@example.com"}, to: []string{"alice@example.com"}, cc: []string{`"Zoë, Müller" <zoe@example.com>`}, bcc: []string{"bob@example.com"}},
+		},
+		{
+			name:    "international to address",
+			message: message{from: []string{"sender@example.com"}, to: []string{"Jürgen <müller@例え.jp>"}, bcc: []string{"bob@example.com"}},
+		},
+		{
+			name:    "bcc in reply-to",
+			message: message{from: []string{"sender@example.com"}, replyTo: []string{"Bob <bob@example.com>"}, to: []string{"alice@example.com"}, bcc: []string{"bob@example.com"}},
+			wantErr: "bcc address bob@example.com would be visible in the email headers",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.message.body = "Hello"
+			_, err := tt.message.bytes()
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr):
+				t.Errorf("expected error %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestMixedNewlines(t *testing.T) {
+	m := message{
+		from:    []string{"sender@example.com"},
+		to:      []string{"alice@example.com"},
+		subject: "Hello",
+		body:    "Hello Alice,\n\r\nThe first line ends with LF,\r\nthe second with CRLF.\n\nBye\r\n",
+	}
+	data, err := m.bytes()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	lines := strings.Split(string(data), "\r\n")
+	for i, line := range lines {
+		if strings.ContainsAny(line, "\r\n") {
+			t.Errorf("line %d has a bare line ending: %q", i, line)
+		}
+	}
+	_, body, _ := strings.Cut(string(data), "\r\n\r\n")
+	want := "Hello Alice,\r\n\r\nThe first line ends with LF,\r\nthe second with CRLF.\r\n\r\nBye\r\n\r\n"
+	if body != want {
+		t.Errorf("expected the body %q, got %q", want, body)
+	}
+}
+
+func TestPlainTextCharset(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		charset  string
+		wantType string
+	}{
+		{name: "ascii body", body: "Hello Zoe", charset: "UTF-8"},
+		{name: "non-ascii body", body: "Hello Zoë", charset: "UTF-8", wantType: `text/plain; charset="UTF-8"`},
+		{name: "default charset", body: "Hello Zoë", wantType: `text/plain; charset="UTF-8"`},
+		{name: "other charset", body: "Hello Zoe", charset: "ISO-8859-1", wantType: `text/plain; charset="ISO-8859-1"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := message{
+				from:    []string{"sender@example.com"},
+				to:      []string{"alice@example.com"},
+				subject: "Hello",
+				body:    tt.body,
+				charset: tt.charset,
+			}
+			data, err := m.bytes()
+			if err != nil {
+				t.Fatalf("assembling the message: %v", err)
+			}
+			header := readHeader(t, data)
+			if got := header.Get("Content-Type"); got != tt.wantType {
+				t.Errorf("expected the Content-Type %q, got %q", tt.wantType, got)
+			}
+			if _, ok := header["Mime-Version"]; ok != (tt.wantType != "") {
+				t.Errorf("expected the MIME-Version header along with the Content-Type, got %v", header)
+			}
+		})
+	}
+}
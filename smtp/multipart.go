@@ -0,0 +1,148 @@
+package smtp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// inlineImage is an image embedded in an HTML email, referenced from the HTML
+// part by its Content-ID, eg. <img src="cid:logo">.
+type inlineImage struct {
+	contentID   string
+	contentType string
+	data        []byte
+}
+
+// attachment is a file attached to an email.
+type attachment struct {
+	filename    string
+	contentType string
+	data        []byte
+}
+
+// part is a base64 encoded part of a multipart body.
+type part struct {
+	header textproto.MIMEHeader
+	data   []byte
+}
+
+// related wraps the body in a multipart/related structure along with the
+// inline images. It returns the multipart body and its content headers.
+func related(seed, body, contentHeader string, images []inlineImage) (string, string, error) {
+	var parts []part
+	for _, image := range images {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", image.contentType)
+		// Set the Content-ID as is, Set would canonicalize it to Content-Id.
+		header["Content-ID"] = []string{"<" + image.contentID + ">"}
+		header.Set("Content-Disposition", "inline")
+		parts = append(parts, part{header: header, data: image.data})
+	}
+	return multipartBody(seed, "related", `; type="text/html"`, body, contentHeader, parts)
+}
+
+// mixed wraps the body in a multipart/mixed structure along with the
+// attachments. It returns the multipart body and its content headers.
+func mixed(seed, body, contentHeader string, attachments []attachment) (string, string, error) {
+	var parts []part
+	for _, file := range attachments {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", file.contentType)
+		header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": file.filename}))
+		parts = append(parts, part{header: header, data: file.data})
+	}
+	return multipartBody(seed, "mixed", "", body, contentHeader, parts)
+}
+
+// alternative wraps the body in a multipart/alternative structure along with
+// the calendar invite, which calendar aware mail clients show with the body.
+// It returns the multipart body and its content headers.
+func alternative(seed, body, contentHeader string, invite *calendarInvite) (string, string, error) {
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", `text/calendar; charset="UTF-8"; method=`+invite.method)
+	return multipartBody(seed, "alternative", "", body, contentHeader, []part{{header: header, data: invite.bytes(time.Now())}})
+}
+
+// multipartBody assembles a multipart body of the given subtype, with the body
+// as its first part followed by the other parts. The boundary is derived from
+// the seed when set. It returns the multipart body and its content headers.
+func multipartBody(seed, subtype, params, body, contentHeader string, parts []part) (string, string, error) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	if seed != "" {
+		if err := w.SetBoundary(seededBoundary(seed, subtype)); err != nil {
+			return "", "", err
+		}
+	}
+
+	first, err := w.CreatePart(partHeader(contentHeader))
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := first.Write([]byte(body)); err != nil {
+		return "", "", err
+	}
+
+	for _, p := range parts {
+		p.header.Set("Content-Transfer-Encoding", "base64")
+		next, err := w.CreatePart(p.header)
+		if err != nil {
+			return "", "", err
+		}
+		if _, err := next.Write([]byte(encodeBase64Lines(p.data))); err != nil {
+			return "", "", err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return "", "", err
+	}
+	return buf.String(), "MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/" + subtype + "; boundary=\"" + w.Boundary() + "\"" + params + "\r\n", nil
+}
+
+// seededBoundary derives the boundary of the multipart subtype from the seed.
+// It starts with =_, which quoted-printable content cannot contain.
+func seededBoundary(seed, subtype string) string {
+	sum := sha256.Sum256([]byte(seed + "/" + subtype))
+	return "=_" + hex.EncodeToString(sum[:24])
+}
+
+// partHeader converts the content headers of a single part message into the
+// headers of a part of a multipart message. A plain text body without content
+// headers gets the default ones.
+func partHeader(contentHeader string) textproto.MIMEHeader {
+	header := textproto.MIMEHeader{}
+	for _, line := range strings.Split(contentHeader, "\r\n") {
+		name, value, ok := strings.Cut(line, ": ")
+		if !ok || name == "MIME-Version" {
+			continue
+		}
+		header.Set(name, value)
+	}
+	if len(header) == 0 {
+		header.Set("Content-Type", `text/plain; charset="UTF-8"`)
+	}
+	return header
+}
+
+// encodeBase64Lines base64 encodes the data in lines of wrapLineLength
+// characters.
+func encodeBase64Lines(data []byte) string {
+	encoded := base64.StdEncoding.EncodeToString(data)
+
+	var lines strings.Builder
+	for len(encoded) > wrapLineLength {
+		lines.WriteString(encoded[:wrapLineLength] + "\r\n")
+		encoded = encoded[wrapLineLength:]
+	}
+	lines.WriteString(encoded + "\r\n")
+	return lines.String()
+}
@@ -0,0 +1,464 @@
+package smtp
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-framework/provider"
+	"github.com/hashicorp/terraform-plugin-framework/providerserver"
+	"github.com/hashicorp/terraform-plugin-framework/tfsdk"
+	"github.com/hashicorp/terraform-plugin-go/tfprotov6"
+	"github.com/hashicorp/terraform-plugin-go/tftypes"
+)
+
+// providerTest drives the provider through the protocol calls Terraform makes
+// to plan and apply the resources, without the Terraform CLI.
+type providerTest struct {
+	t       *testing.T
+	server  tfprotov6.ProviderServer
+	schemas *tfprotov6.GetProviderSchemaResponse
+}
+
+// applyResult is the outcome of planning and applying a resource change.
+type applyResult struct {
+	state           tftypes.Value
+	requiresReplace []*tftypes.AttributePath
+	diags           []*tfprotov6.Diagnostic
+}
+
+// serverConfig returns the provider configuration sending to the server in
+// the clear without authentication, along with the given attributes.
+func serverConfig(s *smtpServer, attributes map[string]any) map[string]any {
+	config := map[string]any{
+		"host":           s.host,
+		"port":           s.port,
+		"authentication": false,
+		"tls_mode":       "none",
+		"default_from":   "sender@example.com",
+	}
+	for name, value := range attributes {
+		config[name] = value
+	}
+	return config
+}
+
+// newProviderTest configures the provider with the configuration, failing the
+// test on error diagnostics.
+func newProviderTest(t *testing.T, config map[string]any) *providerTest {
+	t.Helper()
+
+	p, diags := configureProviderTest(t, config)
+	if err := diagnosticsError(diags); err != "" {
+		t.Fatalf("configuring the provider: %s", err)
+	}
+	return p
+}
+
+// configureProviderTest configures the provider with the configuration,
+// returning the diagnostics.
+func configureProviderTest(t *testing.T, config map[string]any) (*providerTest, []*tfprotov6.Diagnostic) {
+	t.Helper()
+	ctx := context.Background()
+
+	server := providerserver.NewProtocol6(New())()
+	schemas, err := server.GetProviderSchema(ctx, &tfprotov6.GetProviderSchemaRequest{})
+	if err != nil {
+		t.Fatalf("getting the provider schema: %v", err)
+	}
+	p := &providerTest{t: t, server: server, schemas: schemas}
+
+	typ := schemas.Provider.ValueType()
+	raw := p.dynamicValue(typ, toValue(t, typ, config))
+	validated, err := server.ValidateProviderConfig(ctx, &tfprotov6.ValidateProviderConfigRequest{Config: raw})
+	if err != nil {
+		t.Fatalf("validating the provider configuration: %v", err)
+	}
+	if diagnosticsError(validated.Diagnostics) != "" {
+		return p, validated.Diagnostics
+	}
+	configured, err := server.ConfigureProvider(ctx, &tfprotov6.ConfigureProviderRequest{Config: raw})
+	if err != nil {
+		t.Fatalf("configuring the provider: %v", err)
+	}
+	return p, configured.Diagnostics
+}
+
+// configureClient configures the provider with the configuration, returning
+// the client the resources send with.
+func configureClient(t *testing.T, config map[string]any) *client {
+	t.Helper()
+	ctx := context.Background()
+
+	p := New()
+	var schemaResp provider.SchemaResponse
+	p.Schema(ctx, provider.SchemaRequest{}, &schemaResp)
+	typ := schemaResp.Schema.Type().TerraformType(ctx)
+
+	var resp provider.ConfigureResponse
+	p.Configure(ctx, provider.ConfigureRequest{
+		Config: tfsdk.Config{Schema: schemaResp.Schema, Raw: toValue(t, typ, config)},
+	}, &resp)
+	if resp.Diagnostics.HasError() {
+		t.Fatalf("configuring the provider: %v", resp.Diagnostics)
+	}
+	return resp.ResourceData.(*client)
+}
+
+// create plans and applies the creation of the resource with the
+// configuration.
+func (p *providerTest) create(typeName string, config map[string]any) applyResult {
+	p.t.Helper()
+	return p.update(typeName, tftypes.NewValue(p.resourceSchema(typeName).ValueType(), nil), config)
+}
+
+// update plans and applies the change of the resource with the prior state to
+// the configuration.
+func (p *providerTest) update(typeName string, prior tftypes.Value, config map[string]any) applyResult {
+	p.t.Helper()
+	ctx := context.Background()
+
+	schema := p.resourceSchema(typeName)
+	typ := schema.ValueType()
+	configValue := toValue(p.t, typ, config)
+	rawConfig := p.dynamicValue(typ, configValue)
+	rawPrior := p.dynamicValue(typ, prior)
+
+	validated, err := p.server.ValidateResourceConfig(ctx, &tfprotov6.ValidateResourceConfigRequest{TypeName: typeName, Config: rawConfig})
+	if err != nil {
+		p.t.Fatalf("validating %s: %v", typeName, err)
+	}
+	result := applyResult{state: prior, diags: validated.Diagnostics}
+	if diagnosticsError(result.diags) != "" {
+		return result
+	}
+
+	planned, err := p.server.PlanResourceChange(ctx, &tfprotov6.PlanResourceChangeRequest{
+		TypeName:         typeName,
+		PriorState:       rawPrior,
+		ProposedNewState: p.dynamicValue(typ, proposedNewState(p.t, schema, prior, configValue)),
+		Config:           rawConfig,
+	})
+	if err != nil {
+		p.t.Fatalf("planning %s: %v", typeName, err)
+	}
+	result.requiresReplace = planned.RequiresReplace
+	result.diags = append(result.diags, planned.Diagnostics...)
+	if diagnosticsError(result.diags) != "" {
+		return result
+	}
+
+	applied, err := p.server.ApplyResourceChange(ctx, &tfprotov6.ApplyResourceChangeRequest{
+		TypeName:       typeName,
+		PriorState:     rawPrior,
+		PlannedState:   planned.PlannedState,
+		Config:         rawConfig,
+		PlannedPrivate: planned.PlannedPrivate,
+	})
+	if err != nil {
+		p.t.Fatalf("applying %s: %v", typeName, err)
+	}
+	result.diags = append(result.diags, applied.Diagnostics...)
+	if applied.NewState != nil {
+		result.state, err = applied.NewState.Unmarshal(typ)
+		if err != nil {
+			p.t.Fatalf("reading the %s state: %v", typeName, err)
+		}
+	}
+	return result
+}
+
+// read reads the data source with the configuration.
+func (p *providerTest) read(typeName string, config map[string]any) (tftypes.Value, []*tfprotov6.Diagnostic) {
+	p.t.Helper()
+	ctx := context.Background()
+
+	schema, ok := p.schemas.DataSourceSchemas[typeName]
+	if !ok {
+		p.t.Fatalf("unknown data source %s", typeName)
+	}
+	typ := schema.ValueType()
+	resp, err := p.server.ReadDataSource(ctx, &tfprotov6.ReadDataSourceRequest{
+		TypeName: typeName,
+		Config:   p.dynamicValue(typ, toValue(p.t, typ, config)),
+	})
+	if err != nil {
+		p.t.Fatalf("reading %s: %v", typeName, err)
+	}
+	if resp.State == nil {
+		return tftypes.NewValue(typ, nil), resp.Diagnostics
+	}
+	state, err := resp.State.Unmarshal(typ)
+	if err != nil {
+		p.t.Fatalf("reading the %s state: %v", typeName, err)
+	}
+	return state, resp.Diagnostics
+}
+
+func (p *providerTest) resourceSchema(typeName string) *tfprotov6.Schema {
+	p.t.Helper()
+	schema, ok := p.schemas.ResourceSchemas[typeName]
+	if !ok {
+		p.t.Fatalf("unknown resource %s", typeName)
+	}
+	return schema
+}
+
+func (p *providerTest) dynamicValue(typ tftypes.Type, value tftypes.Value) *tfprotov6.DynamicValue {
+	p.t.Helper()
+	raw, err := tfprotov6.NewDynamicValue(typ, value)
+	if err != nil {
+		p.t.Fatalf("encoding the value: %v", err)
+	}
+	return &raw
+}
+
+// mustApply fails the test on the error diagnostics of the result.
+func (r applyResult) mustApply(t *testing.T) applyResult {
+	t.Helper()
+	if err := diagnosticsError(r.diags); err != "" {
+		t.Fatalf("applying the resource: %s", err)
+	}
+	return r
+}
+
+// proposedNewState merges the configuration with the prior state as
+// Terraform does: the computed attributes left out of the configuration keep
+// their prior value.
+func proposedNewState(t *testing.T, schema *tfprotov6.Schema, prior, config tftypes.Value) tftypes.Value {
+	t.Helper()
+	if prior.IsNull() {
+		return config
+	}
+
+	var priorAttrs, attrs map[string]tftypes.Value
+	if err := prior.As(&priorAttrs); err != nil {
+		t.Fatalf("reading the prior state: %v", err)
+	}
+	if err := config.As(&attrs); err != nil {
+		t.Fatalf("reading the configuration: %v", err)
+	}
+	for _, attribute := range schema.Block.Attributes {
+		if attribute.Computed && attrs[attribute.Name].IsNull() {
+			attrs[attribute.Name] = priorAttrs[attribute.Name]
+		}
+	}
+	return tftypes.NewValue(config.Type(), attrs)
+}
+
+// toValue converts the Go value, eg. a map[string]any for an object or a
+// []string for a list, to a value of the type. Nil is the null value, and the
+// attributes left out of an object are null.
+func toValue(t *testing.T, typ tftypes.Type, v any) tftypes.Value {
+	t.Helper()
+	if v == nil {
+		return tftypes.NewValue(typ, nil)
+	}
+	if value, ok := v.(tftypes.Value); ok {
+		return value
+	}
+
+	switch typ := typ.(type) {
+	case tftypes.Object:
+		attrs := map[string]tftypes.Value{}
+		given, ok := v.(map[string]any)
+		if !ok {
+			t.Fatalf("expected a map[string]any for %s, got %T", typ, v)
+		}
+		for name := range given {
+			if _, ok := typ.AttributeTypes[name]; !ok {
+				t.Fatalf("unknown attribute %s", name)
+			}
+		}
+		for name, attrType := range typ.AttributeTypes {
+			attrs[name] = toValue(t, attrType, given[name])
+		}
+		return tftypes.NewValue(typ, attrs)
+	case tftypes.List:
+		return tftypes.NewValue(typ, toElements(t, typ.ElementType, v))
+	case tftypes.Set:
+		return tftypes.NewValue(typ, toElements(t, typ.ElementType, v))
+	case tftypes.Map:
+		elements := map[string]tftypes.Value{}
+		rv := reflect.ValueOf(v)
+		for _, key := range rv.MapKeys() {
+			elements[key.String()] = toValue(t, typ.ElementType, rv.MapIndex(key).Interface())
+		}
+		return tftypes.NewValue(typ, elements)
+	}
+
+	// Dynamic attributes take the type of the given value.
+	if typ.Is(tftypes.DynamicPseudoType) {
+		switch v := v.(type) {
+		case string:
+			return tftypes.NewValue(tftypes.String, v)
+		case []string:
+			listType := tftypes.List{ElementType: tftypes.String}
+			return tftypes.NewValue(listType, toElements(t, tftypes.String, v))
+		}
+		t.Fatalf("unsupported dynamic value %T", v)
+	}
+	return tftypes.NewValue(typ, v)
+}
+
+func toElements(t *testing.T, typ tftypes.Type, v any) []tftypes.Value {
+	t.Helper()
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice {
+		t.Fatalf("expected a slice for a %s list, got %T", typ, v)
+	}
+	elements := make([]tftypes.Value, rv.Len())
+	for i := range elements {
+		elements[i] = toValue(t, typ, rv.Index(i).Interface())
+	}
+	return elements
+}
+
+// stateAttr returns the attribute of the state at the path of attribute names
+// and list indexes.
+func stateAttr(t *testing.T, state tftypes.Value, steps ...any) tftypes.Value {
+	t.Helper()
+	path := tftypes.NewAttributePath()
+	for _, step := range steps {
+		switch step := step.(type) {
+		case string:
+			path = path.WithAttributeName(step)
+		case int:
+			path = path.WithElementKeyInt(step)
+		}
+	}
+	value, _, err := tftypes.WalkAttributePath(state, path)
+	if err != nil {
+		t.Fatalf("reading %s from the state: %v", path, err)
+	}
+	return value.(tftypes.Value)
+}
+
+// stateString returns the string attribute of the state.
+func stateString(t *testing.T, state tftypes.Value, steps ...any) string {
+	t.Helper()
+	var s string
+	value := stateAttr(t, state, steps...)
+	if value.IsNull() {
+		return ""
+	}
+	if err := value.As(&s); err != nil {
+		t.Fatalf("reading the string: %v", err)
+	}
+	return s
+}
+
+// diagnosticsError returns the error diagnostics joined, or an empty string
+// when there is none.
+func diagnosticsError(diags []*tfprotov6.Diagnostic) string {
+	var errs []string
+	for _, d := range diags {
+		if d.Severity == tfprotov6.DiagnosticSeverityError {
+			errs = append(errs, d.Summary+": "+d.Detail)
+		}
+	}
+	return strings.Join(errs, "; ")
+}
+
+// diagnosticSummaries returns the sorted summaries of the diagnostics of the
+// severity.
+func diagnosticSummaries(diags []*tfprotov6.Diagnostic, severity tfprotov6.DiagnosticSeverity) []string {
+	var summaries []string
+	for _, d := range diags {
+		if d.Severity == severity {
+			summaries = append(summaries, d.Summary)
+		}
+	}
+	sort.Strings(summaries)
+	return summaries
+}
+
+func TestSendMailToServer(t *testing.T) {
+	s := startSMTPServer(t, smtpServerOptions{})
+	p := newProviderTest(t, serverConfig(s, nil))
+
+	result := p.create("smtp_send_mail", map[string]any{
+		"to":      []string{"alice@example.com"},
+		"subject": "Hello",
+		"body":    "Hello Alice",
+	}).mustApply(t)
+
+	messages := s.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(messages))
+	}
+	if messages[0].from != "sender@example.com" || !reflect.DeepEqual(messages[0].to, []string{"alice@example.com"}) {
+		t.Errorf("unexpected envelope: from %s to %v", messages[0].from, messages[0].to)
+	}
+	header := readHeader(t, messages[0].data)
+	if header.Get("Subject") != "Hello" || header.Get("Message-ID") != stateString(t, result.state, "message_id") {
+		t.Errorf("unexpected header: %v", header)
+	}
+}
+
+func TestAccessTokenFile(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("ya29.token\r\n\n"), 0o600); err != nil {
+		t.Fatalf("writing the token file: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		config    map[string]any
+		wantError string
+	}{
+		{name: "xoauth2", config: map[string]any{"auth_mechanism": "xoauth2", "access_token_file": tokenFile}},
+		{name: "oauthbearer", config: map[string]any{"auth_mechanism": "oauthbearer", "access_token_file": tokenFile}},
+		{
+			name:      "conflicting inline token",
+			config:    map[string]any{"auth_mechanism": "xoauth2", "access_token_file": tokenFile, "access_token": "ya29.token"},
+			wantError: "Conflicting SMTP Access Token",
+		},
+		{
+			name:      "unreadable file",
+			config:    map[string]any{"auth_mechanism": "xoauth2", "access_token_file": filepath.Join(t.TempDir(), "missing")},
+			wantError: "Invalid SMTP Access Token File",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startSMTPServer(t, smtpServerOptions{
+				users:      map[string]string{"user@example.com": "ya29.token"},
+				mechanisms: []string{"XOAUTH2", "OAUTHBEARER"},
+			})
+			config := serverConfig(s, map[string]any{"authentication": true, "username": "user@example.com"})
+			for name, value := range tt.config {
+				config[name] = value
+			}
+			p, diags := configureProviderTest(t, config)
+
+			if tt.wantError != "" {
+				var found bool
+				for _, d := range diags {
+					if d.Summary == tt.wantError {
+						found = d.Attribute.Equal(tftypes.NewAttributePath().WithAttributeName("access_token_file"))
+					}
+				}
+				if !found {
+					t.Errorf("expected the %q error at the access_token_file attribute, got %q", tt.wantError, diagnosticsError(diags))
+				}
+				return
+			}
+			if err := diagnosticsError(diags); err != "" {
+				t.Fatalf("configuring the provider: %s", err)
+			}
+			p.create("smtp_send_mail", map[string]any{
+				"to":      []string{"alice@example.com"},
+				"subject": "Hello",
+				"body":    "Hello Alice",
+			}).mustApply(t)
+			if got := s.Messages()[0].user; got != "user@example.com" {
+				t.Errorf("expected the message to be sent as user@example.com, got %q", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package smtp
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// recipientsEmailField is the column of a CSV recipients file, or the key of
+// a JSON recipients file, holding the email address of the recipient.
+const recipientsEmailField = "email"
+
+// fileRecipient is a recipient read from a recipients file, along with the
+// variables used to render the body of its email.
+type fileRecipient struct {
+	line    int
+	address string
+	vars    map[string]string
+}
+
+// readRecipientsFile reads the recipients from a CSV or JSON file, depending
+// on its extension. The errors point at the line of the file at fault.
+func readRecipientsFile(name string) ([]fileRecipient, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var recipients []fileRecipient
+	switch ext := strings.ToLower(filepath.Ext(name)); ext {
+	case ".csv":
+		recipients, err = parseRecipientsCSV(data)
+	case ".json":
+		recipients, err = parseRecipientsJSON(data)
+	default:
+		return nil, fmt.Errorf("unsupported recipients file extension %q, expected .csv or .json", ext)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(recipients) == 0 {
+		return nil, errors.New("the recipients file lists no recipients")
+	}
+	return recipients, nil
+}
+
+// parseRecipientsCSV parses a CSV file whose first row names the columns. The
+// email column holds the addresses, and every column is a template variable.
+func parseRecipientsCSV(data []byte) ([]fileRecipient, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.TrimLeadingSpace = true
+
+	header, err := r.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	column := -1
+	for i, name := range header {
+		header[i] = strings.TrimSpace(name)
+		if strings.EqualFold(header[i], recipientsEmailField) {
+			column = i
+		}
+	}
+	if column < 0 {
+		return nil, fmt.Errorf("line 1: missing the %s column", recipientsEmailField)
+	}
+
+	var recipients []fileRecipient
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return recipients, nil
+		}
+		if err != nil {
+			// The csv.ParseError already holds the line.
+			return nil, err
+		}
+
+		line, _ := r.FieldPos(0)
+		vars := map[string]string{}
+		for i, value := range record {
+			vars[header[i]] = value
+		}
+		recipient, err := newFileRecipient(line, record[column], vars)
+		if err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, recipient)
+	}
+}
+
+// parseRecipientsJSON parses a JSON array of objects. The email key holds the
+// addresses, and every key is a template variable.
+func parseRecipientsJSON(data []byte) ([]fileRecipient, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	token, err := dec.Token()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, jsonLineError(data, err)
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return nil, fmt.Errorf("line %d: expected an array of recipients", lineAt(data, dec.InputOffset()))
+	}
+
+	var recipients []fileRecipient
+	for dec.More() {
+		line := lineAt(data, nextValueOffset(data, dec.InputOffset()))
+
+		var entry map[string]any
+		if err := dec.Decode(&entry); err != nil {
+			return nil, jsonLineError(data, err)
+		}
+
+		vars := map[string]string{}
+		for key, value := range entry {
+			switch value := value.(type) {
+			case string:
+				vars[key] = value
+			case json.Number, bool:
+				vars[key] = fmt.Sprint(value)
+			default:
+				return nil, fmt.Errorf("line %d: the %s value must be a string, a number or a boolean", line, key)
+			}
+		}
+		recipient, err := newFileRecipient(line, vars[recipientsEmailField], vars)
+		if err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, recipient)
+	}
+
+	if _, err := dec.Token(); err != nil {
+		return nil, jsonLineError(data, err)
+	}
+	return recipients, nil
+}
+
+// newFileRecipient validates the address of the recipient at the line.
+func newFileRecipient(line int, address string, vars map[string]string) (fileRecipient, error) {
+	address = strings.TrimSpace(address)
+	if address == "" {
+		return fileRecipient{}, fmt.Errorf("line %d: missing the %s address", line, recipientsEmailField)
+	}
+	if _, err := bareAddress(address); err != nil {
+		return fileRecipient{}, fmt.Errorf("line %d: %w", line, err)
+	}
+	return fileRecipient{line: line, address: address, vars: vars}, nil
+}
+
+// jsonLineError prefixes the JSON decoding error with the line at fault.
+func jsonLineError(data []byte, err error) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		return fmt.Errorf("line %d: %w", lineAt(data, syntaxErr.Offset), err)
+	case errors.As(err, &typeErr):
+		return fmt.Errorf("line %d: %w", lineAt(data, typeErr.Offset), err)
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return fmt.Errorf("line %d: unexpected end of the recipients file", lineAt(data, int64(len(data))))
+	}
+	return err
+}
+
+// nextValueOffset skips the whitespace and the separator following the offset,
+// to reach the start of the next value of a JSON array.
+func nextValueOffset(data []byte, offset int64) int64 {
+	for offset < int64(len(data)) && strings.IndexByte(" \t\r\n,", data[offset]) >= 0 {
+		offset++
+	}
+	return offset
+}
+
+// lineAt returns the line of the data holding the byte at the offset.
+func lineAt(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return 1 + bytes.Count(data[:offset], []byte("\n"))
+}
@@ -0,0 +1,66 @@
+package smtp
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadRecipientsFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    []fileRecipient
+		wantErr string
+	}{
+		{
+			name:    "csv",
+			file:    "recipients.csv",
+			content: "name, email\nAlice, alice@example.com\n\"Bob, Jr\", Bob <bob@example.com>\n",
+			want: []fileRecipient{
+				{line: 2, address: "alice@example.com", vars: map[string]string{"name": "Alice", "email": "alice@example.com"}},
+				{line: 3, address: "Bob <bob@example.com>", vars: map[string]string{"name": "Bob, Jr", "email": "Bob <bob@example.com>"}},
+			},
+		},
+		{
+			name:    "json",
+			file:    "recipients.json",
+			content: "[\n  {\"email\": \"alice@example.com\", \"seats\": 2},\n  {\"email\": \"bob@example.com\", \"admin\": true}\n]\n",
+			want: []fileRecipient{
+				{line: 2, address: "alice@example.com", vars: map[string]string{"email": "alice@example.com", "seats": "2"}},
+				{line: 3, address: "bob@example.com", vars: map[string]string{"email": "bob@example.com", "admin": "true"}},
+			},
+		},
+		{name: "csv without the email column", file: "recipients.csv", content: "name\nAlice\n", wantErr: "line 1: missing the email column"},
+		{name: "csv invalid address", file: "recipients.csv", content: "email\nalice@example.com\nbob\n", wantErr: "line 3: invalid email address \"bob\": mail: missing '@' or angle-addr"},
+		{name: "json missing address", file: "recipients.json", content: "[\n{\"email\": \"alice@example.com\"},\n{\"name\": \"Bob\"}\n]", wantErr: "line 3: missing the email address"},
+		{name: "json nested value", file: "recipients.json", content: "[{\"email\": \"alice@example.com\", \"tags\": []}]", wantErr: "line 1: the tags value must be a string, a number or a boolean"},
+		{name: "json syntax error", file: "recipients.json", content: "[\n{\"email\": \"alice@example.com\"}\n{]", wantErr: "line 3: invalid character '{' after array element"},
+		{name: "empty", file: "recipients.json", content: "[]", wantErr: "the recipients file lists no recipients"},
+		{name: "unsupported extension", file: "recipients.txt", wantErr: `unsupported recipients file extension ".txt", expected .csv or .json`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(name, []byte(tt.content), 0o600); err != nil {
+				t.Fatalf("writing the recipients file: %v", err)
+			}
+
+			got, err := readRecipientsFile(name)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("expected error %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("reading the recipients: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected the recipients %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
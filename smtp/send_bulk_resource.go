@@ -0,0 +1,408 @@
+package smtp
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/resource"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/booldefault"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+)
+
+// Ensure the implementation satisfies the expected interfaces.
+var (
+	_ resource.Resource                   = &sendBulkResource{}
+	_ resource.ResourceWithConfigure      = &sendBulkResource{}
+	_ resource.ResourceWithValidateConfig = &sendBulkResource{}
+)
+
+// NewSendBulkResource is a helper function to simplify the provider implementation.
+func NewSendBulkResource() resource.Resource {
+	return &sendBulkResource{}
+}
+
+// sendBulkResource is the resource implementation.
+type sendBulkResource struct {
+	client *client
+}
+
+type sendBulkModel struct {
+	ID             types.String `tfsdk:"id"`
+	From           types.String `tfsdk:"from"`
+	RenderHtml     types.Bool   `tfsdk:"render_html"`
+	Messages       types.List   `tfsdk:"messages"`
+	RecipientsFile types.String `tfsdk:"recipients_file"`
+	Subject        types.String `tfsdk:"subject"`
+	Body           types.String `tfsdk:"body"`
+	FailOnError    types.Bool   `tfsdk:"fail_on_error"`
+	ResendOnUpdate types.Bool   `tfsdk:"resend_on_update"`
+	MessageIDs     types.List   `tfsdk:"message_ids"`
+	FailedMessages types.List   `tfsdk:"failed_messages"`
+}
+
+// bulkMessageModel maps the messages elements to a Go type.
+type bulkMessageModel struct {
+	To           types.List   `tfsdk:"to"`
+	Cc           types.List   `tfsdk:"cc"`
+	Bcc          types.List   `tfsdk:"bcc"`
+	Subject      types.String `tfsdk:"subject"`
+	Body         types.String `tfsdk:"body"`
+	TemplateVars types.Map    `tfsdk:"template_vars"`
+}
+
+// Configure adds the provider configured client to the resource.
+func (r *sendBulkResource) Configure(_ context.Context, req resource.ConfigureRequest, _ *resource.ConfigureResponse) {
+	if req.ProviderData == nil {
+		return
+	}
+
+	r.client = req.ProviderData.(*client)
+}
+
+// Metadata returns the resource type name.
+func (r *sendBulkResource) Metadata(_ context.Context, req resource.MetadataRequest, resp *resource.MetadataResponse) {
+	resp.TypeName = req.ProviderTypeName + "_send_bulk"
+}
+
+// Schema defines the schema for the resource.
+func (r *sendBulkResource) Schema(_ context.Context, _ resource.SchemaRequest, resp *resource.SchemaResponse) {
+	resp.Schema = schema.Schema{
+		Description: "Send several distinct emails with smtp over shared connections. The emails are all sent on create and sent again whenever one of the attributes changes, unless `resend_on_update` is `false`. A failed email does not stop the others and is reported in `failed_messages`, unless `fail_on_error` is `true`.",
+		Attributes: map[string]schema.Attribute{
+			"id": schema.StringAttribute{
+				Description: "Autogenerated UUID for the resource, generated on create and kept across updates.",
+				Computed:    true,
+			},
+			"from": schema.StringAttribute{
+				Optional:    true,
+				Description: "From email address of all the emails. If not provided, the provider `default_from` address, or else the username used in the smtp auth, will be used.",
+			},
+			"render_html": schema.BoolAttribute{
+				Optional:    true,
+				Computed:    true,
+				Description: "Boolean flag is identify whether the bodies are html or plain text. Set this to `true` if the bodies are HTML content (by default, it sets to `false`).",
+				Default:     booldefault.StaticBool(false),
+			},
+			"messages": schema.ListNestedAttribute{
+				Optional:    true,
+				Description: "Emails to send, each with its own recipients, subject and body. At least one of `messages` or `recipients_file` must be set.",
+				NestedObject: schema.NestedAttributeObject{
+					Attributes: map[string]schema.Attribute{
+						"to": schema.ListAttribute{
+							ElementType: types.StringType,
+							Required:    true,
+							Description: "To email addresses.",
+						},
+						"cc": schema.ListAttribute{
+							ElementType: types.StringType,
+							Optional:    true,
+							Description: "CC email addresses.",
+						},
+						"bcc": schema.ListAttribute{
+							ElementType: types.StringType,
+							Optional:    true,
+							Description: "BCC email addresses.",
+						},
+						"subject": schema.StringAttribute{
+							Required:    true,
+							Description: "Subject of the email.",
+						},
+						"body": schema.StringAttribute{
+							Required:    true,
+							Description: "Body of the email.",
+						},
+						"template_vars": schema.MapAttribute{
+							ElementType: types.StringType,
+							Optional:    true,
+							Description: "Variables used to render the body as a Go template, eg. `Hello {{.name}}`. If not provided, the body is sent as is.",
+						},
+					},
+				},
+			},
+			"recipients_file": schema.StringAttribute{
+				Optional:    true,
+				Description: "Path to a CSV or JSON file of recipients, each sent its own email with the `subject` and `body`, after the `messages`. A CSV file starts with a row naming the columns, and a JSON file is an array of objects. The `email` column or key holds the address of the recipient, and all of them are variables used to render the body as a Go template, eg. `Hello {{.name}}`. The file is read when the emails are sent, so changing its content alone does not send the emails again.",
+			},
+			"subject": schema.StringAttribute{
+				Optional:    true,
+				Description: "Subject of the emails sent to the `recipients_file` recipients. Required with `recipients_file`.",
+			},
+			"body": schema.StringAttribute{
+				Optional:    true,
+				Description: "Body of the emails sent to the `recipients_file` recipients, rendered as a Go template with the variables of each recipient. Required with `recipients_file`.",
+			},
+			"fail_on_error": schema.BoolAttribute{
+				Optional:    true,
+				Computed:    true,
+				Description: "Boolean flag to fail the apply when any of the emails cannot be sent. The remaining emails are still sent (by default, it sets to `false`).",
+				Default:     booldefault.StaticBool(false),
+			},
+			"resend_on_update": schema.BoolAttribute{
+				Optional:    true,
+				Computed:    true,
+				Description: "Boolean flag to send the emails again when the attributes change (by default, it sets to `true`). Set this to `false` to only write the changes to the state, along with the prior `message_ids` and `failed_messages`. None of the attributes forces a replacement of the resource, so a change never sends the emails again while it is `false`. Note: A replaced or tainted resource, eg. with `terraform apply -replace`, is created anew and still sends the emails.",
+				Default:     booldefault.StaticBool(true),
+			},
+			"message_ids": schema.ListAttribute{
+				ElementType: types.StringType,
+				Description: "Message-ID header generated for each email, in the order of `messages` followed by the `recipients_file` recipients. Empty for the emails that could not be sent.",
+				Computed:    true,
+			},
+			"failed_messages": schema.ListAttribute{
+				ElementType: types.StringType,
+				Description: "Emails that could not be sent, along with the error, eg. `messages[1]: Error sending email: ...` or `recipients_file line 3: Error sending email: ...`.",
+				Computed:    true,
+			},
+		},
+	}
+}
+
+// ValidateConfig ensures the emails come from messages or recipients_file, and
+// that the subject and body are only set along with the recipients_file.
+func (r *sendBulkResource) ValidateConfig(ctx context.Context, req resource.ValidateConfigRequest, resp *resource.ValidateConfigResponse) {
+	var config sendBulkModel
+	diags := req.Config.Get(ctx, &config)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	if config.Messages.IsUnknown() || config.RecipientsFile.IsUnknown() {
+		return
+	}
+
+	if config.Messages.IsNull() && config.RecipientsFile.IsNull() {
+		resp.Diagnostics.AddAttributeError(
+			path.Root("messages"),
+			"Missing Emails",
+			"One of the messages or recipients_file attributes must be set.",
+		)
+	}
+
+	for attribute, value := range map[string]types.String{
+		"subject": config.Subject,
+		"body":    config.Body,
+	} {
+		switch {
+		case config.RecipientsFile.IsNull() && !value.IsNull():
+			resp.Diagnostics.AddAttributeError(
+				path.Root(attribute),
+				"Conflicting Bulk Email Attributes",
+				fmt.Sprintf("The %s attribute is only used along with recipients_file. Remove it from the configuration.", attribute),
+			)
+		case !config.RecipientsFile.IsNull() && value.IsNull():
+			resp.Diagnostics.AddAttributeError(
+				path.Root(attribute),
+				"Missing Bulk Email Attribute",
+				fmt.Sprintf("The %s attribute is required along with recipients_file.", attribute),
+			)
+		}
+	}
+}
+
+// Create creates the resource and sets the initial Terraform state.
+func (r *sendBulkResource) Create(ctx context.Context, req resource.CreateRequest, resp *resource.CreateResponse) {
+	// Retrieve values from plan
+	var plan sendBulkModel
+	diags := req.Plan.Get(ctx, &plan)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	resp.Diagnostics.Append(sendBulk(ctx, r.client, &plan)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		resp.Diagnostics.AddError("Error generating resource id:", err.Error())
+		return
+	}
+	plan.ID = types.StringValue(id)
+
+	// Set state to fully populated data
+	diags = resp.State.Set(ctx, plan)
+	resp.Diagnostics.Append(diags...)
+}
+
+// Read refreshes the Terraform state with the latest data. Sent emails cannot
+// be read back from the SMTP server, so Read keeps the prior state.
+func (r *sendBulkResource) Read(ctx context.Context, req resource.ReadRequest, resp *resource.ReadResponse) {
+	// Get current state
+	var state sendBulkModel
+	diags := req.State.Get(ctx, &state)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	// Set refreshed state
+	diags = resp.State.Set(ctx, &state)
+	resp.Diagnostics.Append(diags...)
+}
+
+// Update sends the emails again, unless resend_on_update is false, and sets the
+// updated Terraform state on success.
+func (r *sendBulkResource) Update(ctx context.Context, req resource.UpdateRequest, resp *resource.UpdateResponse) {
+	// Retrieve values from plan
+	var plan, state sendBulkModel
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &plan)...)
+	resp.Diagnostics.Append(req.State.Get(ctx, &state)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	plan.ID = state.ID
+	if plan.ResendOnUpdate.ValueBool() {
+		resp.Diagnostics.Append(sendBulk(ctx, r.client, &plan)...)
+		if resp.Diagnostics.HasError() {
+			return
+		}
+	} else {
+		plan.MessageIDs = state.MessageIDs
+		plan.FailedMessages = state.FailedMessages
+	}
+
+	// Set state to fully populated data
+	diags := resp.State.Set(ctx, plan)
+	resp.Diagnostics.Append(diags...)
+}
+
+// Delete removes the Terraform state. Sent emails cannot be recalled, so
+// nothing is sent.
+func (r *sendBulkResource) Delete(_ context.Context, _ resource.DeleteRequest, _ *resource.DeleteResponse) {
+}
+
+// bulkEmail is an email of the bulk send, labelled after where it comes from
+// in the failures.
+type bulkEmail struct {
+	label string
+	mail  sendMailModel
+}
+
+// bulkEmails lists the emails of the messages, followed by the emails to the
+// recipients of the recipients_file.
+func bulkEmails(ctx context.Context, plan *sendBulkModel) ([]bulkEmail, diag.Diagnostics) {
+	var diags diag.Diagnostics
+	var messages []bulkMessageModel
+	if !plan.Messages.IsNull() {
+		diags.Append(plan.Messages.ElementsAs(ctx, &messages, false)...)
+		if diags.HasError() {
+			return nil, diags
+		}
+	}
+
+	var emails []bulkEmail
+	for i, message := range messages {
+		emails = append(emails, bulkEmail{
+			label: fmt.Sprintf("messages[%d]", i),
+			mail: sendMailModel{
+				From:         types.DynamicValue(plan.From),
+				To:           message.To,
+				Cc:           message.Cc,
+				Bcc:          message.Bcc,
+				Subject:      message.Subject,
+				Body:         message.Body,
+				TemplateVars: message.TemplateVars,
+				RenderHtml:   plan.RenderHtml,
+			},
+		})
+	}
+
+	if plan.RecipientsFile.IsNull() {
+		return emails, diags
+	}
+
+	recipients, err := readRecipientsFile(plan.RecipientsFile.ValueString())
+	if err != nil {
+		diags.AddAttributeError(
+			path.Root("recipients_file"),
+			"Error reading recipients file",
+			"Could not read the recipients from "+plan.RecipientsFile.ValueString()+": "+err.Error(),
+		)
+		return nil, diags
+	}
+	for _, recipient := range recipients {
+		vars, d := types.MapValueFrom(ctx, types.StringType, recipient.vars)
+		diags.Append(d...)
+		emails = append(emails, bulkEmail{
+			label: fmt.Sprintf("recipients_file line %d", recipient.line),
+			mail: sendMailModel{
+				From:         types.DynamicValue(plan.From),
+				To:           types.ListValueMust(types.StringType, []attr.Value{types.StringValue(recipient.address)}),
+				Cc:           types.ListNull(types.StringType),
+				Bcc:          types.ListNull(types.StringType),
+				Subject:      plan.Subject,
+				Body:         plan.Body,
+				TemplateVars: vars,
+				RenderHtml:   plan.RenderHtml,
+			},
+		})
+	}
+	return emails, diags
+}
+
+// sendBulk sends the emails of the plan over the shared sessions, and records
+// their Message-IDs and failures in the plan. A failed email only fails the
+// apply when fail_on_error is set.
+func sendBulk(ctx context.Context, c *client, plan *sendBulkModel) (diags diag.Diagnostics) {
+	emails, d := bulkEmails(ctx, plan)
+	diags.Append(d...)
+	if diags.HasError() {
+		return diags
+	}
+
+	// Keep the sessions open until the last email is sent.
+	c.acquire()
+	defer func() {
+		if err := c.release(ctx); err != nil {
+			diags.AddWarning(
+				"Error ending SMTP session",
+				"The SMTP server did not reply as expected to QUIT, the session was closed: "+err.Error(),
+			)
+		}
+	}()
+
+	messageIDs := make([]attr.Value, len(emails))
+	failed := []attr.Value{}
+	for i, email := range emails {
+		mail := email.mail
+		mail.WrapText = types.BoolValue(true)
+		mail.DryRun = types.BoolValue(false)
+
+		var errs []string
+		for _, d := range sendMail(ctx, c, &mail) {
+			if d.Severity() == diag.SeverityError {
+				errs = append(errs, d.Summary()+" "+d.Detail())
+			} else {
+				diags.Append(d)
+			}
+		}
+		if len(errs) == 0 {
+			messageIDs[i] = mail.MessageID
+			continue
+		}
+
+		messageIDs[i] = types.StringValue("")
+		for _, err := range errs {
+			failure := email.label + ": " + err
+			failed = append(failed, types.StringValue(failure))
+			tflog.Warn(ctx, "Failed to send bulk email", map[string]any{"email": email.label, "error": err})
+			if plan.FailOnError.ValueBool() {
+				diags.AddError("Error sending bulk email", failure)
+			}
+		}
+	}
+
+	plan.MessageIDs = types.ListValueMust(types.StringType, messageIDs)
+	plan.FailedMessages = types.ListValueMust(types.StringType, failed)
+	return diags
+}
@@ -0,0 +1,62 @@
+package smtp
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSendBulkRecipientsFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "recipients.csv")
+	if err := os.WriteFile(file, []byte("email,name\nalice@example.com,Alice\nbob@example.com,Bob\n"), 0o600); err != nil {
+		t.Fatalf("writing the recipients file: %v", err)
+	}
+	s := startSMTPServer(t, smtpServerOptions{})
+	p := newProviderTest(t, serverConfig(s, nil))
+	p.create("smtp_send_bulk", map[string]any{
+		"recipients_file": file,
+		"subject":         "Welcome",
+		"body":            "Hello {{.name}}",
+	}).mustApply(t)
+
+	messages := s.Messages()
+	if len(messages) != 2 {
+		t.Fatalf("expected one email per recipient, got %d", len(messages))
+	}
+	for i, want := range []struct{ to, body string }{{"alice@example.com", "Hello Alice"}, {"bob@example.com", "Hello Bob"}} {
+		m := messages[i]
+		if len(m.to) != 1 || m.to[0] != want.to || !strings.HasSuffix(strings.TrimRight(string(m.data), "\r\n"), want.body) {
+			t.Errorf("expected %q to be sent to %s, got %q to %v", want.body, want.to, m.data, m.to)
+		}
+	}
+	if s.Sessions() != 1 {
+		t.Errorf("expected the emails to share a session, got %d sessions", s.Sessions())
+	}
+}
+
+func TestSendBulkResendOnUpdate(t *testing.T) {
+	s := startSMTPServer(t, smtpServerOptions{})
+	p := newProviderTest(t, serverConfig(s, nil))
+	bulk := map[string]any{
+		"messages": []map[string]any{
+			{"to": []string{"alice@example.com"}, "subject": "Hello", "body": "Version 1"},
+		},
+		"resend_on_update": false,
+	}
+	created := p.create("smtp_send_bulk", bulk).mustApply(t)
+	bulk["messages"] = []map[string]any{
+		{"to": []string{"alice@example.com"}, "subject": "Hello", "body": "Version 2"},
+	}
+	updated := p.update("smtp_send_bulk", created.state, bulk).mustApply(t)
+
+	if got := len(s.Messages()); got != 1 {
+		t.Fatalf("expected the emails not to be sent again, got %d emails", got)
+	}
+	if got, want := stateString(t, updated.state, "message_ids", 0), stateString(t, created.state, "message_ids", 0); got != want {
+		t.Errorf("expected the prior Message-ID %q to be kept, got %q", want, got)
+	}
+	if got := stateString(t, updated.state, "messages", 0, "body"); got != "Version 2" {
+		t.Errorf("expected the change to be written to the state, got the body %q", got)
+	}
+}
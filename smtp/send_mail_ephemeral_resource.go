@@ -0,0 +1,145 @@
+package smtp
+
+import (
+	"context"
+
+	"github.com/hashicorp/terraform-plugin-framework/ephemeral"
+	"github.com/hashicorp/terraform-plugin-framework/ephemeral/schema"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+// Ensure the implementation satisfies the expected interfaces.
+var (
+	_ ephemeral.EphemeralResource              = &sendMailEphemeralResource{}
+	_ ephemeral.EphemeralResourceWithConfigure = &sendMailEphemeralResource{}
+)
+
+// NewSendMailEphemeralResource is a helper function to simplify the provider implementation.
+func NewSendMailEphemeralResource() ephemeral.EphemeralResource {
+	return &sendMailEphemeralResource{}
+}
+
+// sendMailEphemeralResource is the ephemeral resource implementation.
+type sendMailEphemeralResource struct {
+	client *client
+}
+
+type sendMailEphemeralModel struct {
+	From        types.String `tfsdk:"from"`
+	To          types.List   `tfsdk:"to"`
+	Cc          types.List   `tfsdk:"cc"`
+	Bcc         types.List   `tfsdk:"bcc"`
+	Subject     types.String `tfsdk:"subject"`
+	Body        types.String `tfsdk:"body"`
+	RenderHtml  types.Bool   `tfsdk:"render_html"`
+	MessageID   types.String `tfsdk:"message_id"`
+	SentVia     types.String `tfsdk:"sent_via"`
+	SentAt      types.String `tfsdk:"sent_at"`
+	MessageSize types.Int64  `tfsdk:"message_size_bytes"`
+}
+
+// Configure adds the provider configured client to the ephemeral resource.
+func (r *sendMailEphemeralResource) Configure(_ context.Context, req ephemeral.ConfigureRequest, _ *ephemeral.ConfigureResponse) {
+	if req.ProviderData == nil {
+		return
+	}
+
+	r.client = req.ProviderData.(*client)
+}
+
+// Metadata returns the ephemeral resource type name.
+func (r *sendMailEphemeralResource) Metadata(_ context.Context, req ephemeral.MetadataRequest, resp *ephemeral.MetadataResponse) {
+	resp.TypeName = req.ProviderTypeName + "_send_mail"
+}
+
+// Schema defines the schema for the ephemeral resource.
+func (r *sendMailEphemeralResource) Schema(_ context.Context, _ ephemeral.SchemaRequest, resp *ephemeral.SchemaResponse) {
+	resp.Schema = schema.Schema{
+		Description: "Send a one-shot email with smtp without storing anything in the state. Note: The email is sent every time Terraform opens the ephemeral resource, which includes plans referencing it.",
+		Attributes: map[string]schema.Attribute{
+			"from": schema.StringAttribute{
+				Optional:    true,
+				Description: "From email address. If not provided, the provider `default_from` address, or else the username used in the smtp auth, will be used.",
+			},
+			"to": schema.ListAttribute{
+				ElementType: types.StringType,
+				Description: "To email addresses.",
+				Required:    true,
+			},
+			"cc": schema.ListAttribute{
+				ElementType: types.StringType,
+				Description: "CC email addresses.",
+				Optional:    true,
+			},
+			"bcc": schema.ListAttribute{
+				ElementType: types.StringType,
+				Description: "BCC email addresses.",
+				Optional:    true,
+			},
+			"subject": schema.StringAttribute{
+				Required:    true,
+				Description: "Subject of the email.",
+			},
+			"body": schema.StringAttribute{
+				Required:    true,
+				Description: "Body of the email.",
+			},
+			"render_html": schema.BoolAttribute{
+				Optional:    true,
+				Description: "Boolean flag is identify whether the body is html or plain text. Set this to `true` if body is a HTML content.",
+			},
+			"message_id": schema.StringAttribute{
+				Description: "Message-ID header generated for the email.",
+				Computed:    true,
+			},
+			"message_size_bytes": schema.Int64Attribute{
+				Description: "Size in bytes of the email as written to the SMTP server, headers and DKIM signature included.",
+				Computed:    true,
+			},
+			"sent_via": schema.StringAttribute{
+				Description: "SMTP host that accepted the email.",
+				Computed:    true,
+			},
+			"sent_at": schema.StringAttribute{
+				Description: "RFC3339 timestamp of when the SMTP server accepted the email.",
+				Computed:    true,
+			},
+		},
+	}
+}
+
+// Open sends the email and returns its Message-ID.
+func (r *sendMailEphemeralResource) Open(ctx context.Context, req ephemeral.OpenRequest, resp *ephemeral.OpenResponse) {
+	// Retrieve values from config
+	var config sendMailEphemeralModel
+	diags := req.Config.Get(ctx, &config)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	// Send through the same path as the managed resource, with its defaults.
+	mail := sendMailModel{
+		From:       types.DynamicValue(config.From),
+		To:         config.To,
+		Cc:         config.Cc,
+		Bcc:        config.Bcc,
+		Subject:    config.Subject,
+		Body:       config.Body,
+		RenderHtml: config.RenderHtml,
+		WrapText:   types.BoolValue(true),
+		DryRun:     types.BoolValue(false),
+	}
+	resp.Diagnostics.Append(sendMail(ctx, r.client, &mail)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	config.MessageID = mail.MessageID
+	config.SentVia = mail.SentVia
+	config.MessageSize = mail.MessageSize
+	config.SentAt = mail.SentAt
+
+	diags = resp.Result.Set(ctx, config)
+	resp.Diagnostics.Append(diags...)
+}
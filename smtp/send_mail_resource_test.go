@@ -0,0 +1,1024 @@
+package smtp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-go/tfprotov6"
+	"github.com/hashicorp/terraform-plugin-go/tftypes"
+)
+
+func TestContentHash(t *testing.T) {
+	s := startSMTPServer(t, smtpServerOptions{})
+	p := newProviderTest(t, serverConfig(s, nil))
+	result := p.create("smtp_send_mail", map[string]any{
+		"to":      []string{"alice@example.com"},
+		"subject": "Hello",
+		"body":    "Hello Alice",
+	}).mustApply(t)
+
+	want := fmt.Sprintf("%x", sha256.Sum256(s.Messages()[0].data))
+	if got := stateString(t, result.state, "content_hash"); got != want {
+		t.Errorf("expected the SHA-256 content hash %s, got %s", want, got)
+	}
+}
+
+func TestFromDomain(t *testing.T) {
+	tests := []struct {
+		name         string
+		from         string
+		fromDomain   any
+		wantEnvelope string
+		wantHeader   string
+		wantErr      string
+	}{
+		{name: "bare local part", from: "alerts", fromDomain: "example.com", wantEnvelope: "alerts@example.com", wantHeader: "alerts@example.com"},
+		{name: "display name", from: "Alerts <alerts>", fromDomain: "example.com", wantEnvelope: "alerts@example.com", wantHeader: "Alerts <alerts@example.com>"},
+		{name: "full address", from: "alerts@example.org", fromDomain: "example.com", wantEnvelope: "alerts@example.org", wantHeader: "alerts@example.org"},
+		{name: "no from domain", from: "alerts", wantErr: "The from address \"alerts\" has no domain"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startSMTPServer(t, smtpServerOptions{})
+			p := newProviderTest(t, serverConfig(s, map[string]any{"from_domain": tt.fromDomain}))
+			result := p.create("smtp_send_mail", map[string]any{
+				"from":    tt.from,
+				"to":      []string{"alice@example.com"},
+				"subject": "Hello",
+				"body":    "Hello Alice",
+			})
+
+			if tt.wantErr != "" {
+				if err := diagnosticsError(result.diags); !strings.Contains(err, tt.wantErr) {
+					t.Errorf("expected an error containing %q, got %q", tt.wantErr, err)
+				}
+				return
+			}
+			result.mustApply(t)
+			m := s.Messages()[0]
+			if m.from != tt.wantEnvelope {
+				t.Errorf("expected the envelope sender %s, got %s", tt.wantEnvelope, m.from)
+			}
+			if got := readHeader(t, m.data).Get("From"); got != tt.wantHeader {
+				t.Errorf("expected the From header %q, got %q", tt.wantHeader, got)
+			}
+		})
+	}
+}
+
+func TestVerifyRecipients(t *testing.T) {
+	s := startSMTPServer(t, smtpServerOptions{
+		rcptReplies: map[string]string{"bob@example.com": "550 5.1.1 unknown user"},
+	})
+	p := newProviderTest(t, serverConfig(s, nil))
+	result := p.create("smtp_send_mail", map[string]any{
+		"to":                []string{"alice@example.com", "bob@example.com"},
+		"subject":           "Hello",
+		"body":              "Hello",
+		"verify_recipients": true,
+	})
+
+	want := "the server rejected 1 of the recipients: bob@example.com: 550 5.1.1 unknown user"
+	if err := diagnosticsError(result.diags); !strings.Contains(err, want) {
+		t.Errorf("expected an error containing %q, got %q", want, err)
+	}
+	if len(s.Messages()) != 0 {
+		t.Errorf("expected the email not to be sent to alice@example.com")
+	}
+}
+
+func TestCalendarInviteUpdate(t *testing.T) {
+	s := startSMTPServer(t, smtpServerOptions{})
+	p := newProviderTest(t, serverConfig(s, nil))
+	invite := map[string]any{
+		"summary": "Planning",
+		"start":   "2025-01-02T15:00:00Z",
+		"end":     "2025-01-02T16:00:00Z",
+	}
+	mail := map[string]any{
+		"to":              []string{"alice@example.com"},
+		"subject":         "Planning",
+		"body":            "Let's plan",
+		"calendar_invite": invite,
+	}
+	created := p.create("smtp_send_mail", mail).mustApply(t)
+	uid := stateString(t, created.state, "calendar_uid")
+
+	invite["method"] = "cancel"
+	mail["body"] = "The planning is cancelled"
+	updated := p.update("smtp_send_mail", created.state, mail).mustApply(t)
+	if got := stateString(t, updated.state, "calendar_uid"); got != uid {
+		t.Errorf("expected the calendar UID %s to be kept, got %s", uid, got)
+	}
+	var sequence *big.Float
+	if err := stateAttr(t, updated.state, "calendar_sequence").As(&sequence); err != nil || sequence.Cmp(big.NewFloat(1)) != 0 {
+		t.Errorf("expected the calendar sequence 1, got %v: %v", sequence, err)
+	}
+
+	messages := s.Messages()
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(messages))
+	}
+	for i, want := range [][]string{
+		{"METHOD:REQUEST", "UID:" + uid, "SEQUENCE:0", "STATUS:CONFIRMED"},
+		{"METHOD:CANCEL", "UID:" + uid, "SEQUENCE:1", "STATUS:CANCELLED"},
+	} {
+		_, calendar := messagePart(t, messages[i].data, func(header textproto.MIMEHeader) bool {
+			return strings.HasPrefix(header.Get("Content-Type"), "text/calendar")
+		})
+		for _, line := range want {
+			if !strings.Contains(calendar, "\r\n"+line+"\r\n") {
+				t.Errorf("expected the calendar of message %d to hold %s, got %q", i+1, line, calendar)
+			}
+		}
+	}
+}
+
+// messagePart returns the header and the decoded content of the first part
+// of the multipart message matching the header.
+func messagePart(t *testing.T, data []byte, match func(textproto.MIMEHeader) bool) (textproto.MIMEHeader, string) {
+	t.Helper()
+	_, params, err := mime.ParseMediaType(readHeader(t, data).Get("Content-Type"))
+	if err != nil {
+		t.Fatalf("parsing the content type: %v", err)
+	}
+	_, body, _ := strings.Cut(string(data), "\r\n\r\n")
+	r := multipart.NewReader(strings.NewReader(body), params["boundary"])
+	for {
+		part, err := r.NextPart()
+		if err != nil {
+			t.Fatalf("expected a matching part: %v", err)
+		}
+		if match(part.Header) {
+			encoded, _ := io.ReadAll(part)
+			decoded, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(string(encoded), "\r\n", ""))
+			if err != nil {
+				t.Fatalf("decoding the part: %v", err)
+			}
+			return part.Header, string(decoded)
+		}
+	}
+}
+
+func TestReplyTo(t *testing.T) {
+	tests := []struct {
+		name           string
+		replyTo        []string
+		defaultReplyTo any
+		want           string
+	}{
+		{name: "none"},
+		{name: "provider default", defaultReplyTo: "support@example.com", want: "support@example.com"},
+		{
+			name:           "resource addresses",
+			replyTo:        []string{"Team <team@example.com>", "lead@example.com"},
+			defaultReplyTo: "support@example.com",
+			want:           "Team <team@example.com>, lead@example.com",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startSMTPServer(t, smtpServerOptions{})
+			p := newProviderTest(t, serverConfig(s, map[string]any{"default_reply_to": tt.defaultReplyTo}))
+			mail := map[string]any{
+				"to":      []string{"alice@example.com"},
+				"subject": "Hello",
+				"body":    "Hello Alice",
+			}
+			if tt.replyTo != nil {
+				mail["reply_to"] = tt.replyTo
+			}
+			p.create("smtp_send_mail", mail).mustApply(t)
+
+			if got := readHeader(t, s.Messages()[0].data).Get("Reply-To"); got != tt.want {
+				t.Errorf("expected the Reply-To header %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestCustomMessageIDSentAgain(t *testing.T) {
+	tests := []struct {
+		name        string
+		autoSuffix  bool
+		wantIDs     []string
+		wantWarning bool
+	}{
+		{name: "warned", wantIDs: []string{"<release@example.com>", "<release@example.com>", "<release@example.com>"}, wantWarning: true},
+		{name: "suffixed", autoSuffix: true, wantIDs: []string{"<release@example.com>", "<release.2@example.com>", "<release.3@example.com>"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startSMTPServer(t, smtpServerOptions{})
+			p := newProviderTest(t, serverConfig(s, nil))
+			mail := map[string]any{
+				"to":                     []string{"alice@example.com"},
+				"subject":                "Release",
+				"body":                   "Version 1",
+				"custom_message_id":      "release@example.com",
+				"auto_suffix_message_id": tt.autoSuffix,
+			}
+			result := p.create("smtp_send_mail", mail).mustApply(t)
+			for i := 2; i <= 3; i++ {
+				mail["body"] = fmt.Sprintf("Version %d", i)
+				result = p.update("smtp_send_mail", result.state, mail).mustApply(t)
+				warned := slices.Contains(diagnosticSummaries(result.diags, tfprotov6.DiagnosticSeverityWarning), "Reused Message-ID")
+				if warned != tt.wantWarning {
+					t.Errorf("expected the reused Message-ID warning %t on send %d, got %q", tt.wantWarning, i, diagnosticSummaries(result.diags, tfprotov6.DiagnosticSeverityWarning))
+				}
+			}
+
+			var ids []string
+			for _, m := range s.Messages() {
+				ids = append(ids, readHeader(t, m.data).Get("Message-ID"))
+			}
+			if !slices.Equal(ids, tt.wantIDs) {
+				t.Errorf("expected the Message-IDs %q, got %q", tt.wantIDs, ids)
+			}
+		})
+	}
+}
+
+func TestAttachmentDownload(t *testing.T) {
+	report := []byte("%PDF-1.4 report")
+	download := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Write(report)
+	}))
+	t.Cleanup(download.Close)
+
+	tests := []struct {
+		name       string
+		attachment map[string]any
+		wantErr    string
+	}{
+		{
+			name:       "downloaded",
+			attachment: map[string]any{"url": download.URL + "/artifacts/report.pdf", "url_headers": map[string]string{"Authorization": "Bearer secret"}},
+		},
+		{
+			name:       "failed download",
+			attachment: map[string]any{"url": download.URL + "/artifacts/report.pdf"},
+			wantErr:    "Could not read the attachment report.pdf: the download failed with the HTTP status 403 Forbidden",
+		},
+		{
+			name:       "too large",
+			attachment: map[string]any{"url": download.URL + "/artifacts/report.pdf", "url_headers": map[string]string{"Authorization": "Bearer secret"}, "max_size_bytes": 4},
+			wantErr:    "Could not read the attachment report.pdf: the attachment exceeds the maximum size of 4 bytes",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startSMTPServer(t, smtpServerOptions{})
+			p := newProviderTest(t, serverConfig(s, nil))
+			result := p.create("smtp_send_mail", map[string]any{
+				"to":          []string{"alice@example.com"},
+				"subject":     "Report",
+				"body":        "The report is attached",
+				"attachments": []map[string]any{tt.attachment},
+			})
+
+			if tt.wantErr != "" {
+				err := diagnosticsError(result.diags)
+				if !strings.Contains(err, tt.wantErr) || strings.Contains(err, download.URL) {
+					t.Errorf("expected an error containing %q without the URL, got %q", tt.wantErr, err)
+				}
+				return
+			}
+			result.mustApply(t)
+			header, content := messagePart(t, s.Messages()[0].data, func(header textproto.MIMEHeader) bool {
+				return strings.HasPrefix(header.Get("Content-Disposition"), "attachment")
+			})
+			if got := header.Get("Content-Disposition"); got != `attachment; filename=report.pdf` {
+				t.Errorf("expected the report.pdf filename, got %q", got)
+			}
+			if header.Get("Content-Type") != "application/pdf" || content != string(report) {
+				t.Errorf("expected the downloaded report, got %q of type %q", content, header.Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestAutoSubmitted(t *testing.T) {
+	tests := []struct {
+		name          string
+		autoSubmitted any
+		want          string
+		wantErr       string
+	}{
+		{name: "default", want: "auto-generated"},
+		{name: "auto-replied", autoSubmitted: "auto-replied", want: "auto-replied"},
+		{name: "no", autoSubmitted: "no"},
+		{name: "invalid", autoSubmitted: "yes", wantErr: "Invalid Auto-Submitted"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startSMTPServer(t, smtpServerOptions{})
+			p := newProviderTest(t, serverConfig(s, nil))
+			result := p.create("smtp_send_mail", map[string]any{
+				"to":             []string{"alice@example.com"},
+				"subject":        "Hello",
+				"body":           "Hello Alice",
+				"auto_submitted": tt.autoSubmitted,
+			})
+
+			if tt.wantErr != "" {
+				if err := diagnosticsError(result.diags); !strings.Contains(err, tt.wantErr) {
+					t.Errorf("expected an error containing %q, got %q", tt.wantErr, err)
+				}
+				return
+			}
+			result.mustApply(t)
+			header := readHeader(t, s.Messages()[0].data)
+			if got := header.Get("Auto-Submitted"); got != tt.want {
+				t.Errorf("expected the Auto-Submitted header %q, got %q", tt.want, got)
+			}
+			if _, ok := header["Auto-Submitted"]; ok == (tt.want == "") {
+				t.Errorf("expected the Auto-Submitted header only when not no, got %v", header)
+			}
+		})
+	}
+}
+
+func TestNullSender(t *testing.T) {
+	s := startSMTPServer(t, smtpServerOptions{})
+	p := newProviderTest(t, serverConfig(s, nil))
+	mail := map[string]any{
+		"to":          []string{"alice@example.com"},
+		"subject":     "Hello",
+		"body":        "Hello Alice",
+		"null_sender": true,
+	}
+	p.create("smtp_send_mail", mail).mustApply(t)
+
+	m := s.Messages()[0]
+	if m.from != "" || !slices.Contains(s.Commands(), "MAIL FROM:<>") {
+		t.Errorf("expected the null envelope sender, got %q", s.Commands())
+	}
+	if got := readHeader(t, m.data).Get("From"); got != "sender@example.com" {
+		t.Errorf("expected the From header to be kept, got %q", got)
+	}
+
+	mail["envelope_from"] = "bounces@example.com"
+	if err := diagnosticsError(p.create("smtp_send_mail", mail).diags); !strings.Contains(err, "Conflicting Null Sender") {
+		t.Errorf("expected envelope_from to conflict with null_sender, got %q", err)
+	}
+}
+
+func TestAutoCharset(t *testing.T) {
+	body := filepath.Join(t.TempDir(), "body.txt")
+	if err := os.WriteFile(body, []byte("Caf\xe9 menu"), 0o600); err != nil {
+		t.Fatalf("writing the body file: %v", err)
+	}
+	// With 8BITMIME, the non-ASCII bodies are sent as is rather than quoted-printable.
+	s := startSMTPServer(t, smtpServerOptions{extensions: []string{"8BITMIME"}})
+	p := newProviderTest(t, serverConfig(s, nil))
+
+	p.create("smtp_send_mail", map[string]any{
+		"to":           []string{"alice@example.com"},
+		"subject":      "Hello",
+		"body":         "Hello Alice",
+		"auto_charset": true,
+	}).mustApply(t)
+	if got := readHeader(t, s.Messages()[0].data).Get("Content-Type"); strings.Contains(got, "charset") {
+		t.Errorf("expected no charset for the ASCII body, got %q", got)
+	}
+
+	p.create("smtp_send_mail", map[string]any{
+		"to":           []string{"alice@example.com"},
+		"subject":      "Hello",
+		"body":         "Grüße, Zoë",
+		"auto_charset": true,
+	}).mustApply(t)
+	if got := readHeader(t, s.Messages()[1].data).Get("Content-Type"); got != `text/plain; charset="UTF-8"` {
+		t.Errorf("expected the UTF-8 charset for the non-ASCII body, got %q", got)
+	}
+
+	result := p.create("smtp_send_mail", map[string]any{
+		"to":           []string{"alice@example.com"},
+		"subject":      "Menu",
+		"body_file":    body,
+		"auto_charset": true,
+	}).mustApply(t)
+	if warnings := diagnosticSummaries(result.diags, tfprotov6.DiagnosticSeverityWarning); !slices.Contains(warnings, "Invalid UTF-8 Body") {
+		t.Errorf("expected the invalid UTF-8 warning, got %q", warnings)
+	}
+	if got := readHeader(t, s.Messages()[2].data).Get("Content-Type"); got != `text/plain; charset="UTF-8"` {
+		t.Errorf("expected the UTF-8 charset for the invalid UTF-8 body, got %q", got)
+	}
+
+	err := diagnosticsError(p.create("smtp_send_mail", map[string]any{
+		"to":           []string{"alice@example.com"},
+		"subject":      "Hello",
+		"body":         "Hello Alice",
+		"charset":      "ISO-8859-1",
+		"auto_charset": true,
+	}).diags)
+	if !strings.Contains(err, "Conflicting Charset") {
+		t.Errorf("expected auto_charset to conflict with charset, got %q", err)
+	}
+}
+
+func TestMaskRecipients(t *testing.T) {
+	s := startSMTPServer(t, smtpServerOptions{
+		rcptReplies: map[string]string{"bob@example.com": "550 5.1.1 unknown user bob@example.com"},
+	})
+	p := newProviderTest(t, serverConfig(s, map[string]any{"mask_recipients": true}))
+	result := p.create("smtp_send_mail", map[string]any{
+		"to":                     []string{"alice@example.com", "bob@example.com"},
+		"subject":                "Hello",
+		"body":                   "Hello",
+		"continue_on_rcpt_error": true,
+	}).mustApply(t)
+
+	if got := s.Messages()[0].to; !slices.Equal(got, []string{"alice@example.com"}) {
+		t.Errorf("expected the email to be sent to the real address, got %q", got)
+	}
+	if got := stateString(t, result.state, "accepted_recipients", 0); got != "a***@example.com" {
+		t.Errorf("expected the masked accepted recipient, got %q", got)
+	}
+	if got := stateString(t, result.state, "rejected_recipients", 0); got != "b***@example.com: 550 5.1.1 unknown user b***@example.com" {
+		t.Errorf("expected the masked rejected recipient, got %q", got)
+	}
+	for _, attribute := range []string{"raw_message", "server_response"} {
+		if value := stateString(t, result.state, attribute); strings.Contains(value, "alice@") || strings.Contains(value, "bob@") {
+			t.Errorf("expected the recipients to be masked in %s, got %q", attribute, value)
+		}
+	}
+}
+
+func TestNegotiated(t *testing.T) {
+	tests := []struct {
+		name    string
+		options smtpServerOptions
+		config  map[string]any
+		want    map[string]any
+	}{
+		{
+			name: "plain session",
+			want: map[string]any{"tls_used": false, "auth_mechanism_used": "", "size_limit": int64(0), "smtputf8_used": false, "chunking_used": false},
+		},
+		{
+			name: "every feature",
+			options: smtpServerOptions{
+				extensions: []string{"SIZE 10240", "SMTPUTF8", "CHUNKING"},
+				starttls:   true,
+				users:      map[string]string{"user": "secret"},
+				mechanisms: []string{"LOGIN"},
+			},
+			config: map[string]any{"authentication": true, "username": "user", "password": "secret", "auth_mechanism": "auto", "tls_mode": "starttls", "use_chunking": true},
+			want:   map[string]any{"tls_used": true, "auth_mechanism_used": "login", "size_limit": int64(10240), "smtputf8_used": true, "chunking_used": true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startSMTPServer(t, tt.options)
+			config := serverConfig(s, tt.config)
+			config["ca_cert_pem"] = s.caPEM
+			p := newProviderTest(t, config)
+			result := p.create("smtp_send_mail", map[string]any{
+				"to":      []string{"alice@example.com"},
+				"subject": "Hello",
+				"body":    "Hello Alice",
+			}).mustApply(t)
+
+			got := map[string]any{"auth_mechanism_used": stateString(t, result.state, "negotiated", "auth_mechanism_used")}
+			for _, name := range []string{"tls_used", "smtputf8_used", "chunking_used"} {
+				var b bool
+				if err := stateAttr(t, result.state, "negotiated", name).As(&b); err != nil {
+					t.Fatalf("reading negotiated.%s: %v", name, err)
+				}
+				got[name] = b
+			}
+			var size *big.Float
+			if err := stateAttr(t, result.state, "negotiated", "size_limit").As(&size); err != nil {
+				t.Fatalf("reading negotiated.size_limit: %v", err)
+			}
+			got["size_limit"], _ = size.Int64()
+			for name, want := range tt.want {
+				if got[name] != want {
+					t.Errorf("expected negotiated.%s to be %v, got %v", name, want, got[name])
+				}
+			}
+		})
+	}
+}
+
+func TestPlusAddressing(t *testing.T) {
+	mail := map[string]any{
+		"to":      []string{"Alice <alice+news@example.com>"},
+		"cc":      []string{"carol+team@example.com"},
+		"bcc":     []string{"bob+archive@example.com"},
+		"subject": "Hello",
+		"body":    "Hello Alice",
+	}
+
+	t.Run("allowed", func(t *testing.T) {
+		s := startSMTPServer(t, smtpServerOptions{})
+		p := newProviderTest(t, serverConfig(s, nil))
+		p.create("smtp_send_mail", mail).mustApply(t)
+
+		m := s.Messages()[0]
+		if want := []string{"alice+news@example.com", "carol+team@example.com", "bob+archive@example.com"}; !reflect.DeepEqual(m.to, want) {
+			t.Errorf("expected the recipients %q, got %q", want, m.to)
+		}
+		header := readHeader(t, m.data)
+		if got := header.Get("To"); got != "Alice <alice+news@example.com>" {
+			t.Errorf("expected the To header to keep the plus address, got %q", got)
+		}
+		if got := header.Get("Cc"); got != "carol+team@example.com" {
+			t.Errorf("expected the Cc header to keep the plus address, got %q", got)
+		}
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		s := startSMTPServer(t, smtpServerOptions{})
+		p := newProviderTest(t, serverConfig(s, map[string]any{"allow_plus_addressing": false}))
+		result := p.create("smtp_send_mail", mail)
+
+		errs := diagnosticSummaries(result.diags, tfprotov6.DiagnosticSeverityError)
+		if want := []string{"Invalid recipient address", "Invalid recipient address", "Invalid recipient address"}; !reflect.DeepEqual(errs, want) {
+			t.Errorf("expected an error per plus address, got %q", diagnosticsError(result.diags))
+		}
+		if verbs := s.Verbs(); len(verbs) != 0 {
+			t.Errorf("expected the SMTP server not to be contacted, got %q", verbs)
+		}
+	})
+}
+
+func TestFromName(t *testing.T) {
+	tests := []struct {
+		name         string
+		config       map[string]any
+		wantFrom     string
+		wantWarnings []string
+		wantErr      string
+	}{
+		{
+			name:     "default sender",
+			config:   map[string]any{"from_name": "Alerts Bot"},
+			wantFrom: `"Alerts Bot" <sender@example.com>`,
+		},
+		{
+			name:     "non-ascii name",
+			config:   map[string]any{"from": "alerts@example.com", "from_name": "Zoë"},
+			wantFrom: "=?UTF-8?q?Zo=C3=AB?= <alerts@example.com>",
+		},
+		{
+			name:         "display name replaced",
+			config:       map[string]any{"from": "Alerts <alerts@example.com>", "from_name": "Alerts Bot"},
+			wantFrom:     `"Alerts Bot" <alerts@example.com>`,
+			wantWarnings: []string{"Overridden From Display Name"},
+		},
+		{
+			name:    "line break",
+			config:  map[string]any{"from_name": "Alerts\r\nBcc: eve@example.com"},
+			wantErr: "Invalid From Name",
+		},
+		{
+			name:    "several authors",
+			config:  map[string]any{"from": []string{"alice@example.com", "bob@example.com"}, "sender": "alice@example.com", "from_name": "Alerts Bot"},
+			wantErr: "Conflicting From Name",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startSMTPServer(t, smtpServerOptions{})
+			p := newProviderTest(t, serverConfig(s, nil))
+			config := map[string]any{
+				"to":      []string{"alice@example.com"},
+				"subject": "Hello",
+				"body":    "Hello Alice",
+			}
+			for name, value := range tt.config {
+				config[name] = value
+			}
+			result := p.create("smtp_send_mail", config)
+
+			if tt.wantErr != "" {
+				if err := diagnosticsError(result.diags); !strings.Contains(err, tt.wantErr) {
+					t.Errorf("expected an error containing %q, got %q", tt.wantErr, err)
+				}
+				return
+			}
+			result.mustApply(t)
+			if got := readHeader(t, s.Messages()[0].data).Get("From"); got != tt.wantFrom {
+				t.Errorf("expected the From header %q, got %q", tt.wantFrom, got)
+			}
+			warnings := diagnosticSummaries(result.diags, tfprotov6.DiagnosticSeverityWarning)
+			if !slices.Equal(warnings, tt.wantWarnings) {
+				t.Errorf("expected the warnings %q, got %q", tt.wantWarnings, warnings)
+			}
+		})
+	}
+}
+
+func TestPrecedence(t *testing.T) {
+	tests := []struct {
+		name       string
+		precedence any
+		want       string
+		wantErr    string
+	}{
+		{name: "unset"},
+		{name: "bulk", precedence: "bulk", want: "bulk"},
+		{name: "invalid", precedence: "first-class", wantErr: "Invalid Precedence"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startSMTPServer(t, smtpServerOptions{})
+			p := newProviderTest(t, serverConfig(s, nil))
+			result := p.create("smtp_send_mail", map[string]any{
+				"to":         []string{"alice@example.com"},
+				"subject":    "Hello",
+				"body":       "Hello Alice",
+				"precedence": tt.precedence,
+			})
+
+			if tt.wantErr != "" {
+				if err := diagnosticsError(result.diags); !strings.Contains(err, tt.wantErr) {
+					t.Errorf("expected an error containing %q, got %q", tt.wantErr, err)
+				}
+				return
+			}
+			result.mustApply(t)
+			lines := headerLines(s.Messages()[0].data)
+			auto := slices.Index(lines, "Auto-Submitted: auto-generated")
+			precedence := slices.IndexFunc(lines, func(line string) bool { return strings.HasPrefix(line, "Precedence:") })
+			if tt.want == "" {
+				if precedence >= 0 {
+					t.Errorf("expected no Precedence header, got %q", lines[precedence])
+				}
+				return
+			}
+			if precedence < 0 || lines[precedence] != "Precedence: "+tt.want {
+				t.Fatalf("expected the Precedence header %q, got %q", tt.want, lines)
+			}
+			if precedence < auto {
+				t.Errorf("expected the Precedence header after Auto-Submitted, got %q", lines)
+			}
+		})
+	}
+}
+
+func TestResendOnUpdate(t *testing.T) {
+	for _, resend := range []bool{true, false} {
+		t.Run(fmt.Sprintf("resend %t", resend), func(t *testing.T) {
+			s := startSMTPServer(t, smtpServerOptions{})
+			p := newProviderTest(t, serverConfig(s, nil))
+			mail := map[string]any{
+				"to":               []string{"alice@example.com"},
+				"subject":          "Hello",
+				"body":             "Version 1",
+				"resend_on_update": resend,
+			}
+			created := p.create("smtp_send_mail", mail).mustApply(t)
+			mail["body"] = "Version 2"
+			updated := p.update("smtp_send_mail", created.state, mail).mustApply(t)
+
+			wantSent := 1
+			if resend {
+				wantSent = 2
+			}
+			if got := len(s.Messages()); got != wantSent {
+				t.Fatalf("expected %d emails to be sent, got %d", wantSent, got)
+			}
+			if got := stateString(t, updated.state, "body"); got != "Version 2" {
+				t.Errorf("expected the change to be written to the state, got the body %q", got)
+			}
+			kept := stateString(t, updated.state, "message_id") == stateString(t, created.state, "message_id")
+			if kept == resend {
+				t.Errorf("expected the Message-ID to be kept only when not sent again, got %q then %q",
+					stateString(t, created.state, "message_id"), stateString(t, updated.state, "message_id"))
+			}
+		})
+	}
+}
+
+func TestBccOnlyInEnvelope(t *testing.T) {
+	s := startSMTPServer(t, smtpServerOptions{})
+	p := newProviderTest(t, serverConfig(s, nil))
+
+	p.create("smtp_send_mail", map[string]any{
+		"to":      []string{"jimbob@example.com"},
+		"cc":      []string{"carol@example.com"},
+		"bcc":     []string{"bob@example.com"},
+		"subject": "Hello",
+		"body":    "Hello",
+	}).mustApply(t)
+
+	messages := s.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(messages))
+	}
+	if want := []string{"jimbob@example.com", "carol@example.com", "bob@example.com"}; !reflect.DeepEqual(messages[0].to, want) {
+		t.Errorf("expected the RCPT addresses %v, got %v", want, messages[0].to)
+	}
+
+	// The to address ends with the bcc one, which must only match as a whole.
+	bcc := regexp.MustCompile(`(?i)(^|[^a-z0-9._%+-])bob@example\.com`)
+	for _, line := range headerLines(messages[0].data) {
+		if bcc.MatchString(line) {
+			t.Errorf("bcc address found in the header line %q", line)
+		}
+	}
+}
+
+func TestLongLinesWithinLimit(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		encoding string
+	}{
+		{name: "words", body: strings.TrimSpace(strings.Repeat("lorem ipsum ", 500))},
+		{name: "no whitespace", body: strings.Repeat("x", 5000), encoding: "quoted-printable"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startSMTPServer(t, smtpServerOptions{})
+			p := newProviderTest(t, serverConfig(s, nil))
+			p.create("smtp_send_mail", map[string]any{
+				"to":      []string{"alice@example.com"},
+				"subject": "Hello",
+				"body":    tt.body,
+			}).mustApply(t)
+
+			data := s.Messages()[0].data
+			for _, line := range strings.Split(string(data), "\r\n") {
+				if len(line) > maxLineLength {
+					t.Fatalf("line of %d octets exceeds the %d octets limit", len(line), maxLineLength)
+				}
+			}
+
+			header := readHeader(t, data)
+			if got := header.Get("Content-Transfer-Encoding"); got != tt.encoding {
+				t.Errorf("expected the %q transfer encoding, got %q", tt.encoding, got)
+			}
+			_, body, _ := strings.Cut(string(data), "\r\n\r\n")
+			body = strings.TrimSuffix(body, "\r\n")
+			if tt.encoding == "quoted-printable" {
+				decoded, err := io.ReadAll(quotedprintable.NewReader(strings.NewReader(body)))
+				if err != nil {
+					t.Fatalf("decoding the body: %v", err)
+				}
+				body = string(decoded)
+			} else {
+				body = strings.ReplaceAll(body, "\r\n", " ")
+			}
+			if body != tt.body {
+				t.Errorf("the body was altered: %q", body)
+			}
+		})
+	}
+}
+
+func TestUpdateSendsOnce(t *testing.T) {
+	tests := []struct {
+		name    string
+		changes map[string]any
+	}{
+		{name: "subject", changes: map[string]any{"subject": "Hello again"}},
+		{name: "body", changes: map[string]any{"body": "Hello again Alice"}},
+		{name: "to", changes: map[string]any{"to": []string{"bob@example.com"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startSMTPServer(t, smtpServerOptions{})
+			p := newProviderTest(t, serverConfig(s, nil))
+			mail := map[string]any{
+				"to":      []string{"alice@example.com"},
+				"subject": "Hello",
+				"body":    "Hello Alice",
+			}
+			created := p.create("smtp_send_mail", mail).mustApply(t)
+
+			for name, value := range tt.changes {
+				mail[name] = value
+			}
+			updated := p.update("smtp_send_mail", created.state, mail).mustApply(t)
+
+			if len(updated.requiresReplace) != 0 {
+				t.Errorf("expected an in-place update, got a replacement for %v", updated.requiresReplace)
+			}
+			messages := s.Messages()
+			if len(messages) != 2 {
+				t.Fatalf("expected exactly one email sent on update, got %d", len(messages)-1)
+			}
+			header := readHeader(t, messages[1].data)
+			if got, want := header.Get("Subject"), mail["subject"]; got != want {
+				t.Errorf("expected the updated email with subject %q, got %q", want, got)
+			}
+		})
+	}
+}
+
+func TestDedupeKeyOnlyGuardsUpdates(t *testing.T) {
+	s := startSMTPServer(t, smtpServerOptions{})
+	p := newProviderTest(t, serverConfig(s, nil))
+	mail := map[string]any{
+		"to":         []string{"alice@example.com"},
+		"subject":    "Hello",
+		"body":       "Hello Alice",
+		"dedupe_key": "welcome",
+	}
+	created := p.create("smtp_send_mail", mail).mustApply(t)
+
+	mail["subject"] = "Hello again"
+	p.update("smtp_send_mail", created.state, mail).mustApply(t)
+	if got := len(s.Messages()); got != 1 {
+		t.Fatalf("expected the update with the same dedupe_key not to send, got %d messages", got)
+	}
+
+	// A replaced resource is created again, which sends whatever the key.
+	p.create("smtp_send_mail", mail).mustApply(t)
+	if got := len(s.Messages()); got != 2 {
+		t.Errorf("expected the created resource to send with the same dedupe_key, got %d messages", got)
+	}
+}
+
+func TestRecipientsDeduplicated(t *testing.T) {
+	s := startSMTPServer(t, smtpServerOptions{})
+	p := newProviderTest(t, serverConfig(s, nil))
+	p.create("smtp_send_mail", map[string]any{
+		"to":      []string{"Alice <Alice@Example.com>", "bob@example.com"},
+		"cc":      []string{"alice@example.com"},
+		"bcc":     []string{"ALICE@example.com", "Bob@Example.com"},
+		"subject": "Hello",
+		"body":    "Hello Alice",
+	}).mustApply(t)
+
+	var rcpts []string
+	for _, command := range s.Commands() {
+		if strings.HasPrefix(command, "RCPT ") {
+			rcpts = append(rcpts, command)
+		}
+	}
+	if want := []string{"RCPT TO:<Alice@Example.com>", "RCPT TO:<bob@example.com>"}; !reflect.DeepEqual(rcpts, want) {
+		t.Errorf("expected a single RCPT per address %q, got %q", want, rcpts)
+	}
+}
+
+func TestMissingFromWithoutAuthentication(t *testing.T) {
+	s := startSMTPServer(t, smtpServerOptions{})
+	p := newProviderTest(t, serverConfig(s, map[string]any{"default_from": nil}))
+	result := p.create("smtp_send_mail", map[string]any{
+		"to":      []string{"alice@example.com"},
+		"subject": "Hello",
+		"body":    "Hello Alice",
+	})
+
+	var found bool
+	for _, d := range result.diags {
+		if d.Severity == tfprotov6.DiagnosticSeverityError && d.Summary == "Missing sender address" {
+			found = d.Attribute.Equal(tftypes.NewAttributePath().WithAttributeName("from"))
+		}
+	}
+	if !found {
+		t.Errorf("expected the missing sender diagnostic at the from attribute, got %q", diagnosticsError(result.diags))
+	}
+	for _, verb := range s.Verbs() {
+		if verb == "MAIL" {
+			t.Fatalf("expected no MAIL command without a sender")
+		}
+	}
+}
+
+func TestInlineImageContentID(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\nlogo")
+	s := startSMTPServer(t, smtpServerOptions{})
+	p := newProviderTest(t, serverConfig(s, nil))
+	p.create("smtp_send_mail", map[string]any{
+		"to":          []string{"alice@example.com"},
+		"subject":     "Hello",
+		"body":        `<p>Hello Alice</p><img src="cid:logo@example.com">`,
+		"render_html": true,
+		"inline_images": []map[string]any{{
+			"content_id":     "logo@example.com",
+			"content_base64": base64.StdEncoding.EncodeToString(png),
+			"content_type":   "image/png",
+		}},
+	}).mustApply(t)
+
+	data := s.Messages()[0].data
+	mediaType, params, err := mime.ParseMediaType(readHeader(t, data).Get("Content-Type"))
+	if err != nil || mediaType != "multipart/related" {
+		t.Fatalf("expected a multipart/related email, got %q: %v", mediaType, err)
+	}
+	_, body, _ := strings.Cut(string(data), "\r\n\r\n")
+	r := multipart.NewReader(strings.NewReader(body), params["boundary"])
+
+	html, err := r.NextPart()
+	if err != nil {
+		t.Fatalf("reading the HTML part: %v", err)
+	}
+	content, _ := io.ReadAll(html)
+	cid := regexp.MustCompile(`src="cid:([^"]+)"`).FindSubmatch(content)
+	if cid == nil {
+		t.Fatalf("expected a cid reference in the HTML part, got %q", content)
+	}
+
+	image, err := r.NextPart()
+	if err != nil {
+		t.Fatalf("reading the image part: %v", err)
+	}
+	if got, want := image.Header.Get("Content-ID"), "<"+string(cid[1])+">"; got != want {
+		t.Errorf("expected the Content-ID %q referenced by the HTML part, got %q", want, got)
+	}
+	encoded, _ := io.ReadAll(image)
+	decoded, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(string(encoded), "\r\n", ""))
+	if err != nil || !bytes.Equal(decoded, png) {
+		t.Errorf("the image was altered: %q, %v", decoded, err)
+	}
+}
+
+func TestFoldedRecipients(t *testing.T) {
+	var to, cc []string
+	for i := 0; i < 50; i++ {
+		to = append(to, fmt.Sprintf("Recipient %02d <recipient%02d@example.com>", i, i))
+		cc = append(cc, fmt.Sprintf("copy%02d@example.com", i))
+	}
+	s := startSMTPServer(t, smtpServerOptions{})
+	p := newProviderTest(t, serverConfig(s, nil))
+	p.create("smtp_send_mail", map[string]any{
+		"to":      to,
+		"cc":      cc,
+		"subject": "Hello",
+		"body":    "Hello everyone",
+	}).mustApply(t)
+
+	data := s.Messages()[0].data
+	for _, line := range headerLines(data) {
+		if len(line) > foldLineLength {
+			t.Errorf("header line of %d characters exceeds %d: %q", len(line), foldLineLength, line)
+		}
+	}
+	header := readHeader(t, data)
+	for name, want := range map[string][]string{"To": to, "Cc": cc} {
+		addresses, err := mail.ParseAddressList(header.Get(name))
+		if err != nil {
+			t.Fatalf("parsing the unfolded %s header: %v", name, err)
+		}
+		var got []string
+		for _, addr := range addresses {
+			got = append(got, addr.String())
+		}
+		want, _ := mail.ParseAddressList(strings.Join(want, ", "))
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("expected the unfolded %s header to hold %q, got %q", name, want, got)
+		}
+	}
+}
+
+func TestMaskVerpEnvelopeSenders(t *testing.T) {
+	s := startSMTPServer(t, smtpServerOptions{})
+	p := newProviderTest(t, serverConfig(s, map[string]any{"mask_recipients": true}))
+	result := p.create("smtp_send_mail", map[string]any{
+		"to":            []string{"user1@example.com", "user2@example.com"},
+		"subject":       "Hello",
+		"body":          "Hello",
+		"envelope_from": "bounces@example.org",
+		"verp":          true,
+	}).mustApply(t)
+
+	if got := len(s.Messages()); got != 2 {
+		t.Fatalf("expected one transaction per recipient, got %d", got)
+	}
+	if got := s.Messages()[0].from; got != "bounces+user1=example.com@example.org" {
+		t.Errorf("expected the real VERP envelope sender to be sent, got %q", got)
+	}
+	var senders map[string]tftypes.Value
+	if err := stateAttr(t, result.state, "verp_envelope_senders").As(&senders); err != nil {
+		t.Fatalf("reading verp_envelope_senders: %v", err)
+	}
+	if len(senders) != 2 {
+		t.Errorf("expected an envelope sender per recipient, got %v", senders)
+	}
+	for _, recipient := range []string{"user1@example.com", "user2@example.com"} {
+		var sender string
+		if err := senders[recipient].As(&sender); err != nil || sender != "b***@example.org" {
+			t.Errorf("expected the masked envelope sender of %s, got %q: %v", recipient, sender, err)
+		}
+	}
+}
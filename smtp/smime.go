@@ -0,0 +1,355 @@
+package smtp
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"mime/multipart"
+	"sort"
+	"strings"
+	"time"
+)
+
+// smime signs and encrypts the MIME entity of a message as per RFC 8551.
+type smime struct {
+	// signer signs the entity in a multipart/signed structure when set, the
+	// chain holding its certificate followed by the intermediate ones.
+	signer crypto.Signer
+	chain  []*x509.Certificate
+	// recipients are the certificates the entity is encrypted for in an
+	// application/pkcs7-mime enveloped-data entity.
+	recipients []*x509.Certificate
+}
+
+var (
+	oidData                   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidEnvelopedData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 3}
+	oidAttributeContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidAttributeMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidAttributeSigningTime   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+	oidSHA256                 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidRSAEncryption          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidECDSAWithSHA256        = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidAES256CBC              = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// contentInfo is the CMS ContentInfo wrapping the signed and enveloped data.
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+type issuerAndSerialNumber struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue
+}
+
+type signerInfo struct {
+	Version            int
+	SID                issuerAndSerialNumber
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo struct {
+		EContentType asn1.ObjectIdentifier
+	}
+	Certificates asn1.RawValue
+	SignerInfos  []signerInfo `asn1:"set"`
+}
+
+type keyTransRecipientInfo struct {
+	Version                int
+	RID                    issuerAndSerialNumber
+	KeyEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedKey           []byte
+}
+
+type envelopedData struct {
+	Version              int
+	RecipientInfos       []keyTransRecipientInfo `asn1:"set"`
+	EncryptedContentInfo struct {
+		ContentType                asn1.ObjectIdentifier
+		ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+		EncryptedContent           asn1.RawValue
+	}
+}
+
+// newSMIME parses the PEM encoded signing certificate and key, and recipient
+// certificates. It returns nil if there is nothing to sign or encrypt with.
+func newSMIME(signCertPEM, signKeyPEM string, recipientPEMs []string) (*smime, error) {
+	s := &smime{}
+	if signCertPEM != "" {
+		pair, err := tls.X509KeyPair([]byte(signCertPEM), []byte(signKeyPEM))
+		if err != nil {
+			return nil, fmt.Errorf("invalid signing certificate or key: %w", err)
+		}
+		for _, der := range pair.Certificate {
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return nil, fmt.Errorf("invalid signing certificate: %w", err)
+			}
+			s.chain = append(s.chain, cert)
+		}
+		switch key := pair.PrivateKey.(type) {
+		case *rsa.PrivateKey:
+			s.signer = key
+		case *ecdsa.PrivateKey:
+			s.signer = key
+		default:
+			return nil, errors.New("the signing key must be an RSA or ECDSA private key")
+		}
+	}
+
+	for i, certPEM := range recipientPEMs {
+		block, _ := pem.Decode([]byte(certPEM))
+		if block == nil {
+			return nil, fmt.Errorf("no PEM encoded certificate found in the encryption certificate %d", i)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption certificate %d: %w", i, err)
+		}
+		if _, ok := cert.PublicKey.(*rsa.PublicKey); !ok {
+			return nil, fmt.Errorf("the encryption certificate %d must hold an RSA public key", i)
+		}
+		s.recipients = append(s.recipients, cert)
+	}
+
+	if s.signer == nil && len(s.recipients) == 0 {
+		return nil, nil
+	}
+	return s, nil
+}
+
+// wrap signs, then encrypts, the MIME entity made of the content headers and
+// the body. It returns the new body and its content headers.
+func (s *smime) wrap(seed, body, contentHeader string) (string, string, error) {
+	var err error
+	if s.signer != nil {
+		if body, contentHeader, err = s.sign(seed, mimeEntity(body, contentHeader)); err != nil {
+			return "", "", err
+		}
+	}
+	if len(s.recipients) > 0 {
+		if body, contentHeader, err = s.encrypt(mimeEntity(body, contentHeader)); err != nil {
+			return "", "", err
+		}
+	}
+	return body, contentHeader, nil
+}
+
+// mimeEntity returns the canonical MIME entity of the body and its content
+// headers, a plain text body without content headers getting the default ones.
+func mimeEntity(body, contentHeader string) string {
+	var header strings.Builder
+	for _, line := range strings.Split(contentHeader, "\r\n") {
+		if line == "" || strings.HasPrefix(line, "MIME-Version:") {
+			continue
+		}
+		header.WriteString(line + "\r\n")
+	}
+	if header.Len() == 0 {
+		header.WriteString("Content-Type: text/plain; charset=\"UTF-8\"\r\n")
+	}
+	return normalizeNewlines(header.String() + "\r\n" + body)
+}
+
+// sign returns the entity in a multipart/signed structure along with its
+// detached signature, and the content headers of the structure.
+func (s *smime) sign(seed, entity string) (string, string, error) {
+	signature, err := s.signedData([]byte(entity))
+	if err != nil {
+		return "", "", fmt.Errorf("the email cannot be signed: %w", err)
+	}
+
+	boundary := multipart.NewWriter(io.Discard).Boundary()
+	if seed != "" {
+		boundary = seededBoundary(seed, "signed")
+	}
+	body := "--" + boundary + "\r\n" +
+		entity + "\r\n" +
+		"--" + boundary + "\r\n" +
+		"Content-Type: application/pkcs7-signature; name=\"smime.p7s\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"Content-Disposition: attachment; filename=\"smime.p7s\"\r\n" +
+		"\r\n" +
+		encodeBase64Lines(signature) +
+		"--" + boundary + "--\r\n"
+	return body, "MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/signed; protocol=\"application/pkcs7-signature\"; micalg=sha-256; boundary=\"" + boundary + "\"\r\n", nil
+}
+
+// signedData returns the DER encoded CMS SignedData detached signature of the
+// content, with the content type, signing time and digest signed attributes.
+func (s *smime) signedData(content []byte) ([]byte, error) {
+	digest := sha256.Sum256(content)
+	attrs, err := signedAttributes([]attributeValue{
+		{oidAttributeContentType, oidData},
+		{oidAttributeSigningTime, time.Now().UTC()},
+		{oidAttributeMessageDigest, digest[:]},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The signature covers the DER encoding of the attributes as a SET.
+	signedAttrs, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: attrs})
+	if err != nil {
+		return nil, err
+	}
+	attrsDigest := sha256.Sum256(signedAttrs)
+	signature, err := s.signer.Sign(rand.Reader, attrsDigest[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	signatureAlgorithm := pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue}
+	if _, ok := s.signer.(*ecdsa.PrivateKey); ok {
+		signatureAlgorithm = pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256}
+	}
+
+	var certs []byte
+	for _, cert := range s.chain {
+		certs = append(certs, cert.Raw...)
+	}
+	signer := s.chain[0]
+	sha256Algorithm := pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue}
+	data := signedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{sha256Algorithm},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: certs},
+		SignerInfos: []signerInfo{{
+			Version:            1,
+			SID:                issuerAndSerialNumber{Issuer: asn1.RawValue{FullBytes: signer.RawIssuer}, SerialNumber: signer.SerialNumber},
+			DigestAlgorithm:    sha256Algorithm,
+			SignedAttrs:        asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: attrs},
+			SignatureAlgorithm: signatureAlgorithm,
+			Signature:          signature,
+		}},
+	}
+	data.EncapContentInfo.EContentType = oidData
+	return marshalContentInfo(oidSignedData, data)
+}
+
+// encrypt returns the entity encrypted with AES-256-CBC in an
+// application/pkcs7-mime enveloped-data entity, and its content headers.
+func (s *smime) encrypt(entity string) (string, string, error) {
+	enveloped, err := s.envelopedData([]byte(entity))
+	if err != nil {
+		return "", "", fmt.Errorf("the email cannot be encrypted: %w", err)
+	}
+	return encodeBase64Lines(enveloped), "MIME-Version: 1.0\r\n" +
+		"Content-Type: application/pkcs7-mime; smime-type=enveloped-data; name=\"smime.p7m\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"Content-Disposition: attachment; filename=\"smime.p7m\"\r\n", nil
+}
+
+// envelopedData returns the DER encoded CMS EnvelopedData of the content, the
+// content encryption key being encrypted for each recipient with RSA.
+func (s *smime) envelopedData(content []byte) ([]byte, error) {
+	key := make([]byte, 32)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	padding := aes.BlockSize - len(content)%aes.BlockSize
+	encrypted := append(append([]byte{}, content...), make([]byte, padding)...)
+	for i := len(content); i < len(encrypted); i++ {
+		encrypted[i] = byte(padding)
+	}
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, encrypted)
+
+	data := envelopedData{}
+	for _, cert := range s.recipients {
+		encryptedKey, err := rsa.EncryptPKCS1v15(rand.Reader, cert.PublicKey.(*rsa.PublicKey), key)
+		if err != nil {
+			return nil, err
+		}
+		data.RecipientInfos = append(data.RecipientInfos, keyTransRecipientInfo{
+			RID:                    issuerAndSerialNumber{Issuer: asn1.RawValue{FullBytes: cert.RawIssuer}, SerialNumber: cert.SerialNumber},
+			KeyEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue},
+			EncryptedKey:           encryptedKey,
+		})
+	}
+
+	ivDER, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	data.EncryptedContentInfo.ContentType = oidData
+	data.EncryptedContentInfo.ContentEncryptionAlgorithm = pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivDER}}
+	data.EncryptedContentInfo.EncryptedContent = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, Bytes: encrypted}
+	return marshalContentInfo(oidEnvelopedData, data)
+}
+
+// marshalContentInfo returns the DER encoded ContentInfo of the content.
+func marshalContentInfo(contentType asn1.ObjectIdentifier, content any) ([]byte, error) {
+	der, err := asn1.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(contentInfo{
+		ContentType: contentType,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: der},
+	})
+}
+
+// attributeValue is a CMS attribute with a single value.
+type attributeValue struct {
+	attrType asn1.ObjectIdentifier
+	value    any
+}
+
+// signedAttributes returns the contents of the DER encoded SET OF the
+// attributes, which DER requires in ascending order of their encoding.
+func signedAttributes(values []attributeValue) ([]byte, error) {
+	var encoded []string
+	for _, v := range values {
+		der, err := asn1.Marshal(v.value)
+		if err != nil {
+			return nil, err
+		}
+		der, err = asn1.Marshal(attribute{
+			Type:   v.attrType,
+			Values: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: der},
+		})
+		if err != nil {
+			return nil, err
+		}
+		encoded = append(encoded, string(der))
+	}
+	sort.Strings(encoded)
+	return []byte(strings.Join(encoded, "")), nil
+}
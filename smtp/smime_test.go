@@ -0,0 +1,184 @@
+package smtp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"mime"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSMIMEContentTypes(t *testing.T) {
+	certPEM, keyPEM := newSMIMECertificate(t)
+
+	tests := []struct {
+		name          string
+		sign, encrypt bool
+		wantType      string
+		wantParams    map[string]string
+	}{
+		{
+			name:       "sign",
+			sign:       true,
+			wantType:   "multipart/signed",
+			wantParams: map[string]string{"protocol": "application/pkcs7-signature", "micalg": "sha-256"},
+		},
+		{
+			name:       "encrypt",
+			encrypt:    true,
+			wantType:   "application/pkcs7-mime",
+			wantParams: map[string]string{"smime-type": "enveloped-data", "name": "smime.p7m"},
+		},
+		{
+			name:       "sign then encrypt",
+			sign:       true,
+			encrypt:    true,
+			wantType:   "application/pkcs7-mime",
+			wantParams: map[string]string{"smime-type": "enveloped-data", "name": "smime.p7m"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := smimeMessage(t, tt.sign, tt.encrypt, certPEM, keyPEM)
+
+			header := readHeader(t, data)
+			mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+			if err != nil || mediaType != tt.wantType {
+				t.Fatalf("expected the %s content type, got %q: %v", tt.wantType, header.Get("Content-Type"), err)
+			}
+			for name, want := range tt.wantParams {
+				if params[name] != want {
+					t.Errorf("expected the %s parameter %q, got %q", name, want, params[name])
+				}
+			}
+			if header.Get("MIME-Version") != "1.0" {
+				t.Errorf("expected the MIME-Version header, got %v", header)
+			}
+			if tt.sign && !tt.encrypt && !bytes.Contains(data, []byte("Content-Type: application/pkcs7-signature; name=\"smime.p7s\"")) {
+				t.Errorf("expected the detached signature part, got %q", data)
+			}
+		})
+	}
+}
+
+func TestSMIMEOpenSSL(t *testing.T) {
+	openssl, err := exec.LookPath("openssl")
+	if err != nil {
+		t.Skip("openssl is not installed")
+	}
+	certPEM, keyPEM := newSMIMECertificate(t)
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, []byte(certPEM), 0o600); err != nil {
+		t.Fatalf("writing the certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, []byte(keyPEM), 0o600); err != nil {
+		t.Fatalf("writing the key: %v", err)
+	}
+
+	run := func(t *testing.T, input []byte, args ...string) []byte {
+		t.Helper()
+		cmd := exec.Command(openssl, args...)
+		cmd.Stdin = bytes.NewReader(input)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("openssl %s: %v: %s", strings.Join(args, " "), err, stderr.String())
+		}
+		return out
+	}
+	verify := func(t *testing.T, signed []byte) {
+		t.Helper()
+		content := run(t, signed, "smime", "-verify", "-CAfile", certFile)
+		if !strings.Contains(string(content), "Hello Alice") {
+			t.Errorf("expected the verified content to hold the body, got %q", content)
+		}
+	}
+	decrypt := func(t *testing.T, encrypted []byte) []byte {
+		t.Helper()
+		return run(t, encrypted, "smime", "-decrypt", "-recip", certFile, "-inkey", keyFile)
+	}
+
+	t.Run("sign", func(t *testing.T) {
+		verify(t, smimeMessage(t, true, false, certPEM, keyPEM))
+	})
+	t.Run("encrypt", func(t *testing.T) {
+		content := decrypt(t, smimeMessage(t, false, true, certPEM, keyPEM))
+		if !strings.Contains(string(content), "Hello Alice") {
+			t.Errorf("expected the decrypted content to hold the body, got %q", content)
+		}
+	})
+	t.Run("sign then encrypt", func(t *testing.T) {
+		verify(t, decrypt(t, smimeMessage(t, true, true, certPEM, keyPEM)))
+	})
+}
+
+// smimeMessage assembles a plain text message signed and encrypted as set,
+// with the certificate for both.
+func smimeMessage(t *testing.T, sign, encrypt bool, certPEM, keyPEM string) []byte {
+	t.Helper()
+
+	var signCertPEM, signKeyPEM string
+	var recipients []string
+	if sign {
+		signCertPEM, signKeyPEM = certPEM, keyPEM
+	}
+	if encrypt {
+		recipients = []string{certPEM}
+	}
+	s, err := newSMIME(signCertPEM, signKeyPEM, recipients)
+	if err != nil {
+		t.Fatalf("parsing the S/MIME certificates: %v", err)
+	}
+	m := message{
+		from:    []string{"sender@example.com"},
+		to:      []string{"alice@example.com"},
+		subject: "Hello",
+		body:    "Hello Alice,\nThis email is protected.\n",
+		smime:   s,
+	}
+	data, err := m.bytes()
+	if err != nil {
+		t.Fatalf("assembling the message: %v", err)
+	}
+	return data
+}
+
+// newSMIMECertificate generates a self-signed RSA certificate for email
+// protection, returning the certificate and key PEM.
+func newSMIMECertificate(t *testing.T) (string, string) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating the S/MIME key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(3),
+		Subject:               pkix.Name{CommonName: "sender@example.com"},
+		EmailAddresses:        []string{"sender@example.com"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating the S/MIME certificate: %v", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+}
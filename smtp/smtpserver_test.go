@@ -0,0 +1,502 @@
+package smtp
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/textproto"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// smtpServerOptions configures the behavior of the in-process SMTP server.
+type smtpServerOptions struct {
+	// extensions are advertised in the EHLO reply, eg. 8BITMIME or SIZE 1000.
+	// STARTTLS and AUTH are advertised on their own from the other options.
+	extensions []string
+	// starttls offers to upgrade the sessions to TLS with STARTTLS, and
+	// implicitTLS wraps the connections in TLS from the start instead.
+	starttls    bool
+	implicitTLS bool
+	// maxTLSVersion caps the TLS version the server negotiates when set.
+	maxTLSVersion uint16
+	// users enables AUTH PLAIN and LOGIN, mapping the usernames to their
+	// password, or access token with XOAUTH2 and OAUTHBEARER. EXTERNAL is
+	// also offered to the TLS sessions.
+	users map[string]string
+	// mechanisms restricts the advertised and accepted AUTH mechanisms when
+	// set, eg. to LOGIN only.
+	mechanisms []string
+	// requireAuth rejects MAIL FROM before a successful AUTH.
+	requireAuth bool
+	// rcptReplies answers RCPT TO for the addresses with the reply instead
+	// of accepting them, eg. "550 5.1.1 unknown user".
+	rcptReplies map[string]string
+	// greylistSessions answers RCPT TO with 451 in the first sessions, as
+	// greylisting servers do until the email is sent again.
+	greylistSessions int
+	// dataDelay delays the final reply to DATA and to the last BDAT chunk.
+	dataDelay time.Duration
+	// hangUpOnMessage closes the connection instead of replying once the
+	// content of the n-th message is read, the message being recorded.
+	hangUpOnMessage int
+	// closeAfterMessage closes the connection after accepting a message, as
+	// servers dropping idle sessions do.
+	closeAfterMessage bool
+	// quitReply answers QUIT instead of 221 when set.
+	quitReply string
+}
+
+// receivedMessage is a message accepted by the in-process SMTP server.
+type receivedMessage struct {
+	// from and to are the envelope addresses, params the MAIL parameters.
+	from   string
+	params []string
+	to     []string
+	// data is the content of the message, undotted when sent with DATA.
+	data []byte
+	// tls reports whether the message was received over TLS, and user is
+	// the authenticated user, if any.
+	tls  bool
+	user string
+}
+
+// smtpServer is an in-process SMTP server the tests send the emails to. It
+// records the commands of every session and the messages it accepts.
+type smtpServer struct {
+	host, port string
+	// caPEM is the PEM encoded certificate of the server, to trust with the
+	// provider ca_cert_pem.
+	caPEM string
+
+	opts      smtpServerOptions
+	tlsConfig *tls.Config
+	listener  net.Listener
+
+	mu       sync.Mutex
+	commands []string
+	messages []receivedMessage
+	sessions int
+}
+
+// startSMTPServer starts an SMTP server on an ephemeral port of the loopback
+// interface, stopped at the end of the test.
+func startSMTPServer(t *testing.T, opts smtpServerOptions) *smtpServer {
+	t.Helper()
+	return startSMTPServerOn(t, "127.0.0.1:0", opts)
+}
+
+// startSMTPServerOn starts an SMTP server listening on the address, eg. on
+// another loopback address for the failover hosts sharing the same port.
+func startSMTPServerOn(t *testing.T, address string, opts smtpServerOptions) *smtpServer {
+	t.Helper()
+
+	s := &smtpServer{opts: opts}
+	s.tlsConfig, s.caPEM = newServerTLSConfig(t)
+	s.tlsConfig.MaxVersion = opts.maxTLSVersion
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	if opts.implicitTLS {
+		listener = tls.NewListener(listener, s.tlsConfig)
+	}
+	s.listener = listener
+	s.host, s.port, _ = net.SplitHostPort(listener.Addr().String())
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+// newServerTLSConfig generates a self-signed certificate for the loopback
+// addresses, returning the server TLS configuration and the certificate PEM.
+func newServerTLSConfig(t *testing.T) (*tls.Config, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating the server key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("generating the server certificate: %v", err)
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+// Commands returns the command lines received so far, across the sessions.
+func (s *smtpServer) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.commands...)
+}
+
+// Verbs returns the verbs of the commands received so far, eg. EHLO or MAIL.
+func (s *smtpServer) Verbs() []string {
+	var verbs []string
+	for _, command := range s.Commands() {
+		verb, _, _ := strings.Cut(command, " ")
+		verbs = append(verbs, strings.ToUpper(verb))
+	}
+	return verbs
+}
+
+// Messages returns the messages accepted so far.
+func (s *smtpServer) Messages() []receivedMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]receivedMessage{}, s.messages...)
+}
+
+// Sessions returns the number of sessions opened so far.
+func (s *smtpServer) Sessions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sessions
+}
+
+func (s *smtpServer) record(command string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commands = append(s.commands, command)
+}
+
+// smtpSession is a session of the in-process SMTP server.
+type smtpSession struct {
+	server *smtpServer
+	conn   net.Conn
+	text   *textproto.Conn
+	tls    bool
+	user   string
+	// number counts the sessions of the server, from 1.
+	number int
+	// message is the transaction in progress, nil before MAIL FROM.
+	message *receivedMessage
+}
+
+func (s *smtpServer) serve(conn net.Conn) {
+	defer conn.Close()
+	s.mu.Lock()
+	s.sessions++
+	number := s.sessions
+	s.mu.Unlock()
+
+	session := &smtpSession{server: s, conn: conn, text: textproto.NewConn(conn), tls: s.opts.implicitTLS, number: number}
+	session.reply("220 localhost ESMTP test server")
+	for {
+		line, err := session.text.ReadLine()
+		if err != nil {
+			return
+		}
+		s.record(line)
+		verb, arg, _ := strings.Cut(line, " ")
+		if !session.handle(strings.ToUpper(verb), arg) {
+			return
+		}
+	}
+}
+
+func (s *smtpSession) reply(lines ...string) {
+	for _, line := range lines {
+		s.text.PrintfLine("%s", line)
+	}
+}
+
+// handle runs the command, reporting false once the session is over.
+func (s *smtpSession) handle(verb, arg string) bool {
+	opts := s.server.opts
+	switch verb {
+	case "EHLO", "HELO":
+		lines := []string{"localhost"}
+		lines = append(lines, opts.extensions...)
+		if opts.starttls && !s.tls {
+			lines = append(lines, "STARTTLS")
+		}
+		if opts.users != nil {
+			lines = append(lines, "AUTH "+strings.Join(s.mechanisms(), " "))
+		}
+		for i, line := range lines {
+			separator := "-"
+			if i == len(lines)-1 {
+				separator = " "
+			}
+			s.reply("250" + separator + line)
+		}
+	case "STARTTLS":
+		if !opts.starttls || s.tls {
+			s.reply("502 5.5.1 STARTTLS not available")
+			break
+		}
+		s.reply("220 2.0.0 Ready to start TLS")
+		tlsConn := tls.Server(s.conn, s.server.tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			return false
+		}
+		s.conn, s.text, s.tls = tlsConn, textproto.NewConn(tlsConn), true
+	case "AUTH":
+		s.auth(arg)
+	case "MAIL":
+		if opts.requireAuth && s.user == "" {
+			s.reply("530 5.7.0 Authentication required")
+			break
+		}
+		addr, params := parsePath(arg, "FROM:")
+		s.message = &receivedMessage{from: addr, params: params, tls: s.tls, user: s.user}
+		s.reply("250 2.1.0 Ok")
+	case "RCPT":
+		if s.message == nil {
+			s.reply("503 5.5.1 MAIL first")
+			break
+		}
+		addr, _ := parsePath(arg, "TO:")
+		if reply, ok := opts.rcptReplies[addr]; ok {
+			s.reply(reply)
+			break
+		}
+		if s.number <= opts.greylistSessions {
+			s.reply("451 4.7.1 Greylisted, try again later")
+			break
+		}
+		s.message.to = append(s.message.to, addr)
+		s.reply("250 2.1.5 Ok")
+	case "DATA":
+		if s.message == nil || len(s.message.to) == 0 {
+			s.reply("503 5.5.1 RCPT first")
+			break
+		}
+		s.reply("354 End data with <CR><LF>.<CR><LF>")
+		data, err := s.readData()
+		if err != nil {
+			return false
+		}
+		s.message.data = data
+		return s.accept()
+	case "BDAT":
+		sizeArg, last, _ := strings.Cut(arg, " ")
+		size, err := strconv.Atoi(sizeArg)
+		if err != nil || s.message == nil {
+			s.reply("501 5.5.4 Invalid BDAT")
+			break
+		}
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(s.text.R, chunk); err != nil {
+			return false
+		}
+		s.message.data = append(s.message.data, chunk...)
+		if !strings.EqualFold(last, "LAST") {
+			s.reply("250 2.0.0 Chunk received")
+			break
+		}
+		return s.accept()
+	case "RSET":
+		s.message = nil
+		s.reply("250 2.0.0 Ok")
+	case "NOOP":
+		s.reply("250 2.0.0 Ok")
+	case "QUIT":
+		if opts.quitReply != "" {
+			s.reply(opts.quitReply)
+			return false
+		}
+		s.reply("221 2.0.0 Bye")
+		return false
+	default:
+		s.reply("502 5.5.2 Command not recognized")
+	}
+	return true
+}
+
+// accept records the message of the transaction once its content is read,
+// reporting false when the session is over.
+func (s *smtpSession) accept() bool {
+	opts := s.server.opts
+	time.Sleep(opts.dataDelay)
+	s.server.mu.Lock()
+	s.server.messages = append(s.server.messages, *s.message)
+	count := len(s.server.messages)
+	s.server.mu.Unlock()
+	s.message = nil
+	if count == opts.hangUpOnMessage {
+		return false
+	}
+	s.reply("250 2.0.0 Ok: queued as TEST" + strconv.Itoa(count))
+	return !opts.closeAfterMessage
+}
+
+// mechanisms returns the AUTH mechanisms offered to the session.
+func (s *smtpSession) mechanisms() []string {
+	if s.server.opts.mechanisms != nil {
+		return s.server.opts.mechanisms
+	}
+	if s.tls {
+		return []string{"PLAIN", "LOGIN", "EXTERNAL"}
+	}
+	return []string{"PLAIN", "LOGIN"}
+}
+
+// auth runs the AUTH exchange of the PLAIN, LOGIN, XOAUTH2, OAUTHBEARER and
+// EXTERNAL mechanisms.
+func (s *smtpSession) auth(arg string) {
+	mechanism, initial, hasInitial := strings.Cut(arg, " ")
+	users := s.server.opts.users
+	if users == nil {
+		s.reply("502 5.5.1 AUTH not available")
+		return
+	}
+
+	mechanism = strings.ToUpper(mechanism)
+	if !slices.Contains(s.mechanisms(), mechanism) {
+		s.reply("504 5.5.4 Unrecognized authentication type")
+		return
+	}
+
+	var username, password string
+	switch mechanism {
+	case "PLAIN":
+		if !hasInitial {
+			initial = s.challenge("")
+		}
+		decoded, _ := base64.StdEncoding.DecodeString(initial)
+		fields := strings.Split(string(decoded), "\x00")
+		if len(fields) != 3 {
+			s.reply("501 5.5.2 Invalid PLAIN response")
+			return
+		}
+		username, password = fields[1], fields[2]
+	case "LOGIN":
+		decoded, _ := base64.StdEncoding.DecodeString(s.challenge("Username:"))
+		username = string(decoded)
+		decoded, _ = base64.StdEncoding.DecodeString(s.challenge("Password:"))
+		password = string(decoded)
+	case "XOAUTH2", "OAUTHBEARER":
+		decoded, _ := base64.StdEncoding.DecodeString(initial)
+		fields := strings.Split(string(decoded), "\x01")
+		for _, field := range fields {
+			switch {
+			case strings.HasPrefix(field, "user="):
+				username = strings.TrimPrefix(field, "user=")
+			case strings.HasPrefix(field, "n,a="):
+				username = strings.TrimSuffix(strings.TrimPrefix(field, "n,a="), ",")
+			case strings.HasPrefix(field, "auth=Bearer "):
+				password = strings.TrimPrefix(field, "auth=Bearer ")
+			}
+		}
+	case "EXTERNAL":
+		if !s.tls {
+			s.reply("504 5.5.4 EXTERNAL requires TLS")
+			return
+		}
+		// The empty initial response "=" acts as the certificate identity.
+		if !hasInitial {
+			initial = s.challenge("")
+		}
+		s.user = "external"
+		if identity, _ := base64.StdEncoding.DecodeString(initial); initial != "=" && len(identity) > 0 {
+			s.user = string(identity)
+		}
+		s.reply("235 2.7.0 Authentication successful")
+		return
+	default:
+		s.reply("504 5.5.4 Unrecognized authentication type")
+		return
+	}
+
+	if expected, ok := users[username]; !ok || expected != password {
+		s.reply("535 5.7.8 Authentication credentials invalid")
+		return
+	}
+	s.user = username
+	s.reply("235 2.7.0 Authentication successful")
+}
+
+// challenge sends the base64 encoded server challenge, and returns the line
+// the client answers with.
+func (s *smtpSession) challenge(prompt string) string {
+	s.reply("334 " + base64.StdEncoding.EncodeToString([]byte(prompt)))
+	line, err := s.text.ReadLine()
+	if err != nil {
+		return ""
+	}
+	s.server.record(line)
+	return line
+}
+
+// parsePath parses the <address> and the parameters of a MAIL FROM or RCPT TO
+// command argument.
+func parsePath(arg, prefix string) (string, []string) {
+	arg = strings.TrimSpace(arg)
+	if len(arg) >= len(prefix) && strings.EqualFold(arg[:len(prefix)], prefix) {
+		arg = strings.TrimSpace(arg[len(prefix):])
+	}
+	path, params, _ := strings.Cut(arg, " ")
+	return strings.TrimSuffix(strings.TrimPrefix(path, "<"), ">"), strings.Fields(params)
+}
+
+// readData reads the content sent with DATA up to the terminating dot line,
+// undotting the lines but keeping their line endings as sent.
+func (s *smtpSession) readData() ([]byte, error) {
+	var data []byte
+	for {
+		line, err := s.text.R.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		if line == ".\r\n" {
+			return data, nil
+		}
+		data = append(data, strings.TrimPrefix(line, ".")...)
+	}
+}
+
+// headerLines returns the lines of the header section of the message, with
+// the folded fields left as is.
+func headerLines(data []byte) []string {
+	header, _, _ := strings.Cut(string(data), "\r\n\r\n")
+	return strings.Split(header, "\r\n")
+}
+
+// readHeader parses the header section of the message.
+func readHeader(t *testing.T, data []byte) textproto.MIMEHeader {
+	t.Helper()
+	header, err := textproto.NewReader(bufio.NewReader(strings.NewReader(string(data)))).ReadMIMEHeader()
+	if err != nil {
+		t.Fatalf("reading the message header: %v", err)
+	}
+	return header
+}
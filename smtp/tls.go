@@ -0,0 +1,63 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+)
+
+// tlsVersions maps the supported min_tls_version values to their TLS versions.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newTLSConfig builds the TLS configuration shared by every connection to the
+// SMTP hosts. Server certificates are verified against the system certificate
+// pool, the CA certificate being appended to it when provided, or against the
+// CA certificate alone without the system pool. They are only left unverified
+// when neither is used.
+func newTLSConfig(minVersion uint16, clientCertPEM, clientKeyPEM, caCertPEM string, useSystemPool bool) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: minVersion, InsecureSkipVerify: true}
+
+	if clientCertPEM != "" {
+		cert, err := tls.X509KeyPair([]byte(clientCertPEM), []byte(clientKeyPEM))
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	pool := x509.NewCertPool()
+	if useSystemPool {
+		system, err := x509.SystemCertPool()
+		if err != nil && caCertPEM == "" {
+			return nil, fmt.Errorf("the system certificate pool cannot be loaded, provide a CA certificate instead: %w", err)
+		}
+		if err == nil {
+			pool = system
+		}
+	}
+
+	if caCertPEM != "" {
+		if !pool.AppendCertsFromPEM([]byte(caCertPEM)) {
+			return nil, errors.New("no valid PEM encoded CA certificate found")
+		}
+	}
+	if useSystemPool || caCertPEM != "" {
+		config.RootCAs = pool
+		config.InsecureSkipVerify = false
+	}
+
+	return config, nil
+}
+
+// tlsConfigFor returns the TLS configuration for a connection to the given host.
+func (c *client) tlsConfigFor(host string) *tls.Config {
+	config := c.tlsConfig.Clone()
+	config.ServerName = host
+	return config
+}
@@ -0,0 +1,46 @@
+package smtp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestServerCertificateVerification(t *testing.T) {
+	tests := []struct {
+		name       string
+		ca         bool
+		systemPool any
+		wantErr    string
+	}{
+		{name: "system pool by default", wantErr: "certificate signed by unknown authority"},
+		{name: "system pool along with the ca", ca: true},
+		{name: "ca only", ca: true, systemPool: false},
+		{name: "unverified", systemPool: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startSMTPServer(t, smtpServerOptions{implicitTLS: true})
+			config := serverConfig(s, map[string]any{"tls_mode": "implicit", "use_system_cert_pool": tt.systemPool})
+			if tt.ca {
+				config["ca_cert_pem"] = s.caPEM
+			}
+			p := newProviderTest(t, config)
+			result := p.create("smtp_send_mail", map[string]any{
+				"to":      []string{"alice@example.com"},
+				"subject": "Hello",
+				"body":    "Hello Alice",
+			})
+
+			err := diagnosticsError(result.diags)
+			if tt.wantErr != "" {
+				if !strings.Contains(err, tt.wantErr) {
+					t.Errorf("expected an error containing %q, got %q", tt.wantErr, err)
+				}
+				return
+			}
+			if err != "" {
+				t.Errorf("unexpected error: %s", err)
+			}
+		})
+	}
+}